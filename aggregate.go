@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+
+	"lib/net/http/pubnub"
+)
+
+// aggregate accumulates the rows of a pubnub_publish_agg group by channel.
+type aggregate struct {
+	channels []string            // Channels in order of appearance
+	rows     map[string][][]byte // Json rows by channel
+	flags    map[string]string   // Flags of the first row by channel
+	result   int                 // Worst publish result of the group
+}
+
+func newAggregate() *aggregate {
+	a := &aggregate{}
+	a.Clear()
+	return a
+}
+
+// Clear resets the aggregate for a new group.
+func (a *aggregate) Clear() {
+	a.channels = nil
+	a.rows = make(map[string][][]byte)
+	a.flags = make(map[string]string)
+	a.result = publishOK
+}
+
+// Add validates a row and appends it to its channel.
+func (a *aggregate) Add(chann string, payload []byte, flags string) {
+	js, err := decodeJSON(payload)
+	if err != nil {
+		logger.Warn("Failed to decode json", "error", err, "payload", string(payload))
+		a.fail(publishInvalid)
+		return
+	}
+
+	channel, v := validate(chann)
+	if !v {
+		logger.Warn("Invalid channel name for publish", "channel", chann, "normalized", channel)
+		a.fail(publishInvalid)
+		return
+	}
+
+	if err := checkMessage(channel, js); err != nil {
+		logger.Warn("Invalid message", "channel", channel, "error", err)
+		a.fail(publishInvalid)
+		return
+	}
+
+	if _, found := a.rows[channel]; !found {
+		a.channels = append(a.channels, channel)
+		a.flags[channel] = flags
+	}
+	a.rows[channel] = append(a.rows[channel], payload)
+}
+
+// Publish queues one json array message per channel, split on max_message_size.
+func (a *aggregate) Publish() int {
+	for _, channel := range a.channels {
+		messages, dropped := batch(channel, a.rows[channel], cfg.MaxMessageSize)
+		if dropped > 0 {
+			logger.Warn("Publish rejected rows", "channel", channel, "rows", dropped, "error", errTooLarge)
+			a.fail(publishTooLarge)
+		}
+		for _, message := range messages {
+			w.Publish(channel, message, a.flags[channel])
+		}
+	}
+	return a.result
+}
+
+func (a *aggregate) fail(result int) {
+	if result > a.result {
+		a.result = result
+	}
+}
+
+// batch joins rows into json arrays whose publish size does not exceed max.
+// Rows that do not fit in a message on their own are dropped and counted.
+func batch(channel string, rows [][]byte, max int) ([][]byte, int) {
+	var (
+		messages [][]byte
+		buf      bytes.Buffer
+		dropped  int
+	)
+
+	// Path encoding is done byte by byte so sizes add up
+	empty := pubnub.PublishSize(channel, "[]")
+	comma := pubnub.PublishSize("", ",")
+	size := empty
+
+	flush := func() {
+		if buf.Len() > 0 {
+			buf.WriteByte(']')
+			messages = append(messages, append([]byte(nil), buf.Bytes()...))
+			buf.Reset()
+			size = empty
+		}
+	}
+
+	for _, row := range rows {
+		rowSize := pubnub.PublishSize("", string(row))
+		if empty+rowSize > max {
+			dropped++
+			continue
+		}
+
+		if buf.Len() > 0 && size+comma+rowSize > max {
+			flush()
+		}
+
+		if buf.Len() == 0 {
+			buf.WriteByte('[')
+		} else {
+			buf.WriteByte(',')
+			size += comma
+		}
+		buf.Write(row)
+		size += rowSize
+	}
+	flush()
+
+	return messages, dropped
+}
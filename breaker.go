@@ -0,0 +1,161 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"lib/net/http/pubnub"
+)
+
+// Circuit breaker states
+const (
+	breakerClosed   = "closed"    // Deliveries run
+	breakerOpen     = "open"      // Deliveries paused
+	breakerHalfOpen = "half_open" // One probe delivery runs
+)
+
+var errBreakerOpen = errors.New("pubnub circuit breaker open")
+
+type (
+	// breaker pauses deliveries after threshold consecutive failures to
+	// reach PubNub, then lets one probe through every cooldown until one
+	// succeeds. The methods of a nil breaker allow everything.
+	breaker struct {
+		mu        sync.Mutex
+		threshold int
+		cooldown  time.Duration
+
+		state    string
+		failures int       // Consecutive failures
+		changed  time.Time // Last state change
+		probe    time.Time // Start of the half-open probe, zero when none
+		opened   int64     // Times opened
+		rejected int64     // Messages and requests refused while open
+	}
+
+	// breakerStatus is the pubnub_status breaker section.
+	breakerStatus struct {
+		State    string    `json:"state"`
+		Failures int       `json:"failures"`
+		Since    time.Time `json:"since"`
+		Opened   int64     `json:"opened"`
+		Rejected int64     `json:"rejected"`
+	}
+)
+
+// newBreaker returns a closed breaker, nil when threshold is 0.
+func newBreaker(threshold int, cooldown time.Duration) *breaker {
+	if threshold < 1 {
+		return nil
+	}
+	return &breaker{
+		threshold: threshold,
+		cooldown:  cooldown,
+		state:     breakerClosed,
+		changed:   time.Now(),
+	}
+}
+
+// Allow is true when a delivery may run: always when closed, once every
+// cooldown as a probe otherwise.
+func (b *breaker) Allow() bool {
+	if b == nil {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	switch b.state {
+	case breakerClosed:
+		return true
+	case breakerOpen:
+		if now.Sub(b.changed) < b.cooldown {
+			return false
+		}
+		b.set(breakerHalfOpen, now)
+		logger.Info("PubNub circuit breaker half-open, probing")
+	}
+
+	// A probe which never reported, eg. requeued, is replaced
+	if !b.probe.IsZero() && now.Sub(b.probe) < b.cooldown {
+		return false
+	}
+	b.probe = now
+	return true
+}
+
+// Open is true while deliveries are paused or probing.
+func (b *breaker) Open() bool {
+	if b == nil {
+		return false
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state != breakerClosed
+}
+
+// Record updates the breaker with the result of a request.
+func (b *breaker) Record(err error) {
+	if b == nil {
+		return
+	}
+	// Aborted by the caller, eg. the pubnub_grant_token timeout
+	if pubnub.Aborted(err) {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	// Network errors, 5xx and 429 responses, other failures are not
+	// outages of PubNub
+	if !pubnub.Retryable(err) {
+		b.failures = 0
+		if b.state != breakerClosed {
+			b.set(breakerClosed, time.Now())
+			logger.Info("PubNub circuit breaker closed, deliveries resumed")
+		}
+		return
+	}
+
+	b.failures++
+	if b.state == breakerHalfOpen || (b.state == breakerClosed && b.failures >= b.threshold) {
+		b.set(breakerOpen, time.Now())
+		b.opened++
+		logger.Warn("PubNub circuit breaker open, deliveries paused",
+			"failures", b.failures, "retry_in", b.cooldown.String(), "error", err)
+	}
+}
+
+// Reject counts a message or request refused while open.
+func (b *breaker) Reject() {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.rejected++
+}
+
+// Status returns the state and counters, nil for a nil breaker.
+func (b *breaker) Status() *breakerStatus {
+	if b == nil {
+		return nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return &breakerStatus{
+		State:    b.state,
+		Failures: b.failures,
+		Since:    b.changed,
+		Opened:   b.opened,
+		Rejected: b.rejected,
+	}
+}
+
+// set changes the state, b.mu is held.
+func (b *breaker) set(state string, now time.Time) {
+	b.state, b.changed, b.probe = state, now, time.Time{}
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"lib/net/http/pubnub"
+)
+
+// Log formats
+const (
+	logText   = "text"   // 2006/01/02 15:04:05 WARN msg key=value
+	logJSON   = "json"   // {"time":...,"level":...,"msg":...,"key":value}
+	logLogfmt = "logfmt" // time=... level=... msg=... key=value
+)
+
+// redacted replaces secrets in log messages and fields
+const redacted = "[REDACTED]"
+
+var (
+	// Fields never logged as is
+	secretFields = map[string]bool{
+		"auth":       true,
+		"auth_key":   true,
+		"secret_key": true,
+		"signature":  true,
+		"token":      true,
+	}
+
+	// Fields only logged at debug level
+	payloadFields = map[string]bool{
+		"message": true,
+		"payload": true,
+		"body":    true,
+	}
+
+	// Secrets embedded in urls, errors and json
+	secretPatterns = []*regexp.Regexp{
+		regexp.MustCompile(`sec-c-[A-Za-z0-9_-]+`),
+		regexp.MustCompile(`((?:signature|auth|token)=)[^&\s"]+`),
+		regexp.MustCompile(`("(?:auth|auth_key|token|secret_key|signature)"\s*:\s*")[^"]*`),
+	}
+)
+
+// leveledLogger writes leveled and structured messages, it implements
+// pubnub.LevelLogger so the library logs through it.
+type leveledLogger struct {
+	mu      sync.Mutex
+	out     io.Writer
+	level   pubnub.Level
+	format  string
+	secrets []string // Literal values replaced, eg. the configured secret key
+}
+
+var logger = newLogger(cfg)
+
+// newLogger creates the logger described by the configuration, falling
+// back to info level text on stderr.
+func newLogger(c *config) *leveledLogger {
+	l := &leveledLogger{
+		out:    os.Stderr,
+		level:  pubnub.LevelInfo,
+		format: logText,
+	}
+	if c.SecretKey != "" {
+		l.secrets = append(l.secrets, c.SecretKey)
+	}
+
+	if c.LogLevel != "" {
+		level, err := pubnub.ParseLevel(c.LogLevel)
+		if err != nil {
+			l.Warn("Invalid log_level, using info", "error", err)
+		} else {
+			l.level = level
+		}
+	}
+
+	switch c.LogFormat {
+	case "", logText, logJSON, logLogfmt:
+		if c.LogFormat != "" {
+			l.format = c.LogFormat
+		}
+	default:
+		l.Warn("Unknown log_format, using text", "log_format", c.LogFormat)
+	}
+
+	if c.LogFile != "" {
+		f, err := os.OpenFile(c.LogFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0640)
+		if err != nil {
+			l.Error("Failed to open log_file, using stderr", "log_file", c.LogFile, "error", err)
+		} else {
+			l.out = f
+		}
+	}
+
+	return l
+}
+
+func (l *leveledLogger) Debug(msg string, kv ...interface{}) { l.Log(pubnub.LevelDebug, msg, kv...) }
+func (l *leveledLogger) Info(msg string, kv ...interface{})  { l.Log(pubnub.LevelInfo, msg, kv...) }
+func (l *leveledLogger) Warn(msg string, kv ...interface{})  { l.Log(pubnub.LevelWarn, msg, kv...) }
+func (l *leveledLogger) Error(msg string, kv ...interface{}) { l.Log(pubnub.LevelError, msg, kv...) }
+
+// Printf logs at info level, for pubnub.Logger.
+func (l *leveledLogger) Printf(format string, v ...interface{}) {
+	l.Log(pubnub.LevelInfo, fmt.Sprintf(format, v...))
+}
+
+// Log writes msg and its key and value pairs when level is enabled.
+// Secrets are redacted and payload fields are dropped above debug level.
+func (l *leveledLogger) Log(level pubnub.Level, msg string, kv ...interface{}) {
+	if level < l.level {
+		return
+	}
+
+	var keys []string
+	values := make(map[string]string)
+	for i := 0; i+1 < len(kv); i += 2 {
+		key := fmt.Sprint(kv[i])
+		if payloadFields[key] && l.level > pubnub.LevelDebug {
+			continue
+		}
+		value := redacted
+		if !secretFields[key] {
+			value = l.redact(fmt.Sprint(kv[i+1]))
+		}
+		if _, found := values[key]; !found {
+			keys = append(keys, key)
+		}
+		values[key] = value
+	}
+
+	line := l.formatLine(time.Now(), level, l.redact(msg), keys, values)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	io.WriteString(l.out, line)
+}
+
+// redact replaces the configured secrets and the secret patterns.
+func (l *leveledLogger) redact(s string) string {
+	for _, secret := range l.secrets {
+		s = strings.Replace(s, secret, redacted, -1)
+	}
+	for _, re := range secretPatterns {
+		if re.NumSubexp() > 0 {
+			s = re.ReplaceAllString(s, "${1}"+redacted)
+		} else {
+			s = re.ReplaceAllString(s, redacted)
+		}
+	}
+	return s
+}
+
+func (l *leveledLogger) formatLine(t time.Time, level pubnub.Level, msg string, keys []string, values map[string]string) string {
+	var b strings.Builder
+
+	switch l.format {
+	case logJSON:
+		fields := map[string]string{
+			"time":  t.UTC().Format(time.RFC3339Nano),
+			"level": level.String(),
+			"msg":   msg,
+		}
+		for _, k := range keys {
+			if _, reserved := fields[k]; reserved {
+				fields["field."+k] = values[k]
+				continue
+			}
+			fields[k] = values[k]
+		}
+		// Map keys are sorted by json
+		data, _ := json.Marshal(fields)
+		b.Write(data)
+
+	case logLogfmt:
+		b.WriteString("time=" + t.UTC().Format(time.RFC3339Nano))
+		b.WriteString(" level=" + level.String())
+		b.WriteString(" msg=" + logfmtValue(msg))
+		for _, k := range keys {
+			b.WriteString(" " + k + "=" + logfmtValue(values[k]))
+		}
+
+	default:
+		b.WriteString(t.Format("2006/01/02 15:04:05 "))
+		b.WriteString(strings.ToUpper(level.String()) + " " + msg)
+		for _, k := range keys {
+			b.WriteString(" " + k + "=" + logfmtValue(values[k]))
+		}
+	}
+
+	b.WriteByte('\n')
+	return b.String()
+}
+
+// logfmtValue quotes values containing spaces, quotes or equal signs.
+func logfmtValue(s string) string {
+	if s == "" || strings.ContainsAny(s, " \t\n\r\"=\\") {
+		return strconv.Quote(s)
+	}
+	return s
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// metricsPath is served by the metrics listener
+const metricsPath = "/metrics"
+
+// Exposition formats, exemplars are only written in OpenMetrics
+const (
+	contentTypeText        = "text/plain; version=0.0.4; charset=utf-8"
+	contentTypeOpenMetrics = "application/openmetrics-text; version=1.0.0; charset=utf-8"
+)
+
+// ServeMetrics exposes the worker metrics in the Prometheus text format on
+// addr, the listener is closed by Stop.
+func (w *worker) ServeMetrics(addr string) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(metricsPath, func(rw http.ResponseWriter, r *http.Request) {
+		if strings.Contains(r.Header.Get("Accept"), "application/openmetrics-text") {
+			rw.Header().Set("Content-Type", contentTypeOpenMetrics)
+			w.WriteOpenMetrics(rw)
+			return
+		}
+		rw.Header().Set("Content-Type", contentTypeText)
+		w.WriteMetrics(rw)
+	})
+
+	w.metrics = &http.Server{Handler: mux}
+	go func() {
+		if err := w.metrics.Serve(ln); err != nil && err != http.ErrServerClosed {
+			logger.Error("Metrics listener failed", "error", err)
+		}
+	}()
+
+	return nil
+}
+
+// WriteMetrics writes the worker metrics in the Prometheus text format.
+func (w *worker) WriteMetrics(out io.Writer) {
+	w.writeMetrics(&metricsWriter{out: out})
+}
+
+// WriteOpenMetrics writes the worker metrics in the OpenMetrics format,
+// latency buckets carry the message id of a delivery as exemplar.
+func (w *worker) WriteOpenMetrics(out io.Writer) {
+	m := &metricsWriter{out: out, openMetrics: true}
+	w.writeMetrics(m)
+	io.WriteString(out, "# EOF\n")
+}
+
+func (w *worker) writeMetrics(m *metricsWriter) {
+	st := w.Status()
+
+	w.stats.mu.Lock()
+	responses := make(map[string]map[string]int64, len(w.stats.responses))
+	for op, statuses := range w.stats.responses {
+		responses[op] = make(map[string]int64, len(statuses))
+		for status, n := range statuses {
+			responses[op][status] = n
+		}
+	}
+	durations := make(map[string]*histogram, len(w.stats.durations))
+	for op, h := range w.stats.durations {
+		durations[op] = h.copy()
+	}
+	poolWait := w.stats.poolWait.copy()
+	w.stats.mu.Unlock()
+
+	ops := make([]string, 0, len(st.Operations))
+	for op := range st.Operations {
+		ops = append(ops, op)
+	}
+	sort.Strings(ops)
+
+	m.header("pubnub_udf_queue_depth", "gauge", "Messages waiting for delivery.")
+	m.sample("pubnub_udf_queue_depth", nil, float64(st.Queue))
+
+	m.header("pubnub_udf_inflight_deliveries", "gauge", "Deliveries in progress.")
+	m.sample("pubnub_udf_inflight_deliveries", nil, float64(st.Inflight))
+
+	m.header("pubnub_udf_pool_agents", "gauge", "PubNub agents in the pool.")
+	m.sample("pubnub_udf_pool_agents", nil, float64(st.Pool.Size))
+
+	m.header("pubnub_udf_pool_agents_in_use", "gauge", "PubNub agents checked out of the pool.")
+	m.sample("pubnub_udf_pool_agents_in_use", nil, float64(st.Pool.InUse))
+
+	m.header("pubnub_udf_pool_acquire_timeouts_total", "counter", "Waits of pubnub_grant_token for a PubNub agent given up.")
+	m.sample("pubnub_udf_pool_acquire_timeouts_total", nil, float64(st.Pool.AcquireTimeouts))
+
+	m.header("pubnub_udf_pool_agents_discarded_total", "counter", "PubNub agents replaced after repeated failures.")
+	m.sample("pubnub_udf_pool_agents_discarded_total", nil, float64(st.Pool.Discarded))
+
+	if t := st.Transport; t != nil {
+		m.header("pubnub_udf_http_requests_total", "counter", "HTTP requests sent to PubNub, retries included.")
+		m.sample("pubnub_udf_http_requests_total", nil, float64(t.Requests))
+
+		m.header("pubnub_udf_http_connections_total", "counter", "HTTP requests by connection, reused idle or newly opened.")
+		m.sample("pubnub_udf_http_connections_total", []string{"reused", "true"}, float64(t.Reused))
+		m.sample("pubnub_udf_http_connections_total", []string{"reused", "false"}, float64(t.Created))
+
+		m.header("pubnub_udf_tls_handshakes_total", "counter", "Completed TLS handshakes with PubNub.")
+		m.sample("pubnub_udf_tls_handshakes_total", nil, float64(t.TLSHandshakes))
+	}
+
+	m.header("pubnub_udf_rate_limited_total", "counter", "Messages above the rate limits, by action.")
+	m.sample("pubnub_udf_rate_limited_total", []string{"action", "delayed"}, float64(st.RateLimit.Delayed))
+	m.sample("pubnub_udf_rate_limited_total", []string{"action", "dropped"}, float64(st.RateLimit.Dropped))
+
+	if b := st.Breaker; b != nil {
+		m.header("pubnub_udf_breaker_state", "gauge", "Circuit breaker state, 1 for the current one.")
+		for _, state := range []string{breakerClosed, breakerOpen, breakerHalfOpen} {
+			value := 0.0
+			if b.State == state {
+				value = 1
+			}
+			m.sample("pubnub_udf_breaker_state", []string{"state", state}, value)
+		}
+
+		m.header("pubnub_udf_breaker_opened_total", "counter", "Times the circuit breaker opened.")
+		m.sample("pubnub_udf_breaker_opened_total", nil, float64(b.Opened))
+
+		m.header("pubnub_udf_breaker_rejected_total", "counter", "Publishes and token grants refused while the circuit breaker is open.")
+		m.sample("pubnub_udf_breaker_rejected_total", nil, float64(b.Rejected))
+	}
+
+	m.header("pubnub_udf_messages_total", "counter", "Messages by operation and outcome.")
+	for _, op := range ops {
+		o := st.Operations[op]
+		for _, outcome := range []struct {
+			name  string
+			value int64
+		}{
+			{"enqueued", o.Enqueued},
+			{"delivered", o.Delivered},
+			{"failed", o.Failed},
+			{"dropped", o.Dropped},
+		} {
+			m.sample("pubnub_udf_messages_total", []string{"operation", op, "outcome", outcome.name}, float64(outcome.value))
+		}
+	}
+
+	m.header("pubnub_udf_retries_total", "counter", "Attempts sent again after a retryable error.")
+	for _, op := range ops {
+		m.sample("pubnub_udf_retries_total", []string{"operation", op}, float64(st.Operations[op].Retried))
+	}
+
+	m.header("pubnub_udf_responses_total", "counter", "PubNub responses by operation and HTTP status, error when PubNub was not reached.")
+	for _, op := range ops {
+		statuses := make([]string, 0, len(responses[op]))
+		for status := range responses[op] {
+			statuses = append(statuses, status)
+		}
+		sort.Strings(statuses)
+		for _, status := range statuses {
+			m.sample("pubnub_udf_responses_total", []string{"operation", op, "status", status}, float64(responses[op][status]))
+		}
+	}
+
+	m.header("pubnub_udf_delivery_duration_seconds", "histogram", "Delivery latency including retries.")
+	for _, op := range ops {
+		if h, ok := durations[op]; ok {
+			m.histogram("pubnub_udf_delivery_duration_seconds", []string{"operation", op}, h)
+		}
+	}
+
+	m.header("pubnub_udf_pool_wait_seconds", "histogram", "Wait of deliveries and pubnub_grant_token for a PubNub agent of the pool.")
+	m.histogram("pubnub_udf_pool_wait_seconds", nil, poolWait)
+}
+
+// metricsWriter formats samples in the Prometheus text or OpenMetrics format.
+type metricsWriter struct {
+	out         io.Writer
+	openMetrics bool
+}
+
+func (m *metricsWriter) header(name, kind, help string) {
+	// OpenMetrics counter families are named without the _total suffix
+	if m.openMetrics && kind == "counter" {
+		name = strings.TrimSuffix(name, "_total")
+	}
+	fmt.Fprintf(m.out, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+// sample writes one value, labels are name and value pairs.
+func (m *metricsWriter) sample(name string, labels []string, value float64) {
+	m.exemplar(name, labels, value, exemplar{})
+}
+
+// exemplar writes one value followed by e in OpenMetrics, when e is set.
+func (m *metricsWriter) exemplar(name string, labels []string, value float64, e exemplar) {
+	line := name + formatLabels(labels) + " " + strconv.FormatFloat(value, 'g', -1, 64)
+	if m.openMetrics && e.ID != "" {
+		line += " # " + formatLabels([]string{"message_id", e.ID}) + " " +
+			strconv.FormatFloat(e.Value, 'g', -1, 64) + " " +
+			strconv.FormatFloat(float64(e.Time.UnixNano())/1e9, 'f', 3, 64)
+	}
+	io.WriteString(m.out, line+"\n")
+}
+
+func (m *metricsWriter) histogram(name string, labels []string, h *histogram) {
+	for i, bound := range h.bounds {
+		le := strconv.FormatFloat(bound, 'g', -1, 64)
+		m.exemplar(name+"_bucket", append(labels[:len(labels):len(labels)], "le", le), float64(h.counts[i]), h.exemplars[i])
+	}
+	count := float64(h.counts[len(h.bounds)])
+	m.exemplar(name+"_bucket", append(labels[:len(labels):len(labels)], "le", "+Inf"), count, h.exemplars[len(h.bounds)])
+	m.sample(name+"_sum", labels, h.sum)
+	m.sample(name+"_count", labels, count)
+}
+
+func formatLabels(labels []string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	escape := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+	pairs := make([]string, 0, len(labels)/2)
+	for i := 0; i+1 < len(labels); i += 2 {
+		pairs = append(pairs, labels[i]+`="`+escape.Replace(labels[i+1])+`"`)
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+)
+
+// object is a json object keeping its keys in insertion order,
+// used to build messages from UDF arguments.
+type object struct {
+	keys   []string
+	values map[string]interface{}
+}
+
+func newObject() *object {
+	return &object{values: make(map[string]interface{})}
+}
+
+// Set adds a key, replacing the value of an existing one in place.
+func (o *object) Set(key string, value interface{}) {
+	if _, found := o.values[key]; !found {
+		o.keys = append(o.keys, key)
+	}
+	o.values[key] = value
+}
+
+func (o *object) MarshalJSON() ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for i, key := range o.keys {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		k, err := json.Marshal(key)
+		if err != nil {
+			return nil, err
+		}
+		v, err := json.Marshal(o.values[key])
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(k)
+		buf.WriteByte(':')
+		buf.Write(v)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
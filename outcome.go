@@ -0,0 +1,324 @@
+package main
+
+import (
+	"context"
+	"crypto/rsa"
+	"crypto/x509"
+	"database/sql"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+// Outcome statuses
+const (
+	outcomeDelivered = "delivered"
+	outcomeFailed    = "failed"
+	outcomeDropped   = "dropped"
+)
+
+const (
+	outcomeQueueSize = 10000           // Outcomes waiting for the sink, dropped above
+	outcomeBatchSize = 100             // Rows by INSERT
+	outcomeFlush     = time.Second     // Max wait before an INSERT
+	outcomeRetry     = 5 * time.Second // Wait before reconnecting
+	outcomeTimeout   = 5 * time.Second // Connection and INSERT timeout, and final flush
+)
+
+// outcomePubKey is the name of the server key registered with the driver.
+const outcomePubKey = "pubnub_outcome_sink"
+
+type (
+	// outcome is the delivery result of a message.
+	outcome struct {
+		ID         string
+		Operation  string
+		Channel    string
+		Status     string // delivered, failed or dropped
+		HTTPStatus int    // Last PubNub response, 0 when not reached
+		Timetoken  string
+		Error      string
+		Attempts   int
+		Enqueued   time.Time
+		Finished   time.Time
+	}
+
+	// outcomeSink writes outcomes into a MySQL table in batches, through a
+	// client connection of its own.
+	outcomeSink struct {
+		db    *sql.DB
+		table string
+		queue chan *outcome
+
+		mu      sync.Mutex
+		dropped int64 // Outcomes lost, queue full or INSERT failed
+
+		ctx    context.Context // Cancelled by Stop, INSERTs have their own timeout
+		cancel context.CancelFunc
+		done   chan struct{}
+	}
+
+	// driverLogger sends the messages of the MySQL driver to the plugin log.
+	driverLogger struct{}
+)
+
+// newOutcomeSink creates a sink writing into table of the database of dsn.
+// serverPubKey is the PEM file of the RSA public key of the server, empty
+// when not pinned.
+func newOutcomeSink(dsn, table, serverPubKey string) (*outcomeSink, error) {
+	c, err := mysql.ParseDSN(dsn)
+	if err != nil {
+		return nil, err
+	}
+	if c.Timeout == 0 {
+		c.Timeout = outcomeTimeout
+	}
+	c.Logger = driverLogger{}
+
+	if serverPubKey != "" {
+		key, err := readPublicKey(serverPubKey)
+		if err != nil {
+			return nil, err
+		}
+		mysql.RegisterServerPubKey(outcomePubKey, key)
+		c.ServerPubKey = outcomePubKey
+	}
+	if exposedPassword(c) {
+		return nil, fmt.Errorf("%s over tcp needs tls or outcome_server_public_key", c.Addr)
+	}
+
+	connector, err := mysql.NewConnector(c)
+	if err != nil {
+		return nil, err
+	}
+	db := sql.OpenDB(connector)
+	db.SetMaxOpenConns(1)
+
+	s := &outcomeSink{
+		db:    db,
+		table: table,
+		queue: make(chan *outcome, outcomeQueueSize),
+		done:  make(chan struct{}),
+	}
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+	return s, nil
+}
+
+// readPublicKey reads a PEM encoded RSA public key, as shown by
+// SHOW STATUS LIKE 'Caching_sha2_password_rsa_public_key'.
+func readPublicKey(path string) (*rsa.PublicKey, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM data in %s", path)
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	rsaKey, ok := key.(*rsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("%s is not an RSA public key", path)
+	}
+	return rsaKey, nil
+}
+
+// exposedPassword is true when the password could be sent to an
+// impersonated server: over tcp to another host without TLS, when the
+// caching_sha2_password full authentication encrypts it with the RSA key
+// sent by the server itself.
+func exposedPassword(c *mysql.Config) bool {
+	if c.Net == "unix" || c.ServerPubKey != "" || (c.TLS != nil && !c.AllowFallbackToPlaintext) {
+		return false
+	}
+	host, _, err := net.SplitHostPort(c.Addr)
+	if err != nil {
+		host = c.Addr
+	}
+	if ip := net.ParseIP(host); host == "localhost" || (ip != nil && ip.IsLoopback()) {
+		return false
+	}
+	return true
+}
+
+// Print implements mysql.Logger.
+func (driverLogger) Print(v ...interface{}) {
+	logger.Warn("MySQL driver", "message", strings.TrimSpace(fmt.Sprint(v...)))
+}
+
+// Record queues an outcome, it never blocks the worker.
+func (s *outcomeSink) Record(o *outcome) {
+	select {
+	case s.queue <- o:
+	default:
+		s.drop(1)
+	}
+}
+
+// Dropped returns the number of outcomes lost.
+func (s *outcomeSink) Dropped() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.dropped
+}
+
+func (s *outcomeSink) drop(n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.dropped += int64(n)
+}
+
+// Start runs the writer loop.
+func (s *outcomeSink) Start() {
+	go func() {
+		defer close(s.done)
+
+		var rows []*outcome
+		ticker := time.NewTicker(outcomeFlush)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case o := <-s.queue:
+				rows = append(rows, o)
+				if len(rows) < outcomeBatchSize {
+					continue
+				}
+			case <-ticker.C:
+			case <-s.ctx.Done():
+				// Flush the queued outcomes, the connection may have to be
+				// opened again
+				for len(s.queue) > 0 {
+					rows = append(rows, <-s.queue)
+				}
+				for len(rows) > 0 {
+					n := len(rows)
+					if n > outcomeBatchSize {
+						n = outcomeBatchSize
+					}
+					s.write(rows[:n])
+					rows = rows[n:]
+				}
+				s.db.Close()
+				return
+			}
+
+			if len(rows) > 0 && !s.write(rows) {
+				s.rest()
+			}
+			rows = nil
+		}
+	}()
+}
+
+// Stop writes the queued outcomes and closes the connection.
+func (s *outcomeSink) Stop() {
+	s.cancel()
+	<-s.done
+}
+
+// write inserts rows within outcomeTimeout, the driver reconnects when the
+// connection was lost. It returns false when the server is unreachable.
+func (s *outcomeSink) write(rows []*outcome) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), outcomeTimeout)
+	defer cancel()
+
+	_, err := s.db.ExecContext(ctx, insertOutcomes(s.table, rows))
+	if err == nil {
+		return true
+	}
+	s.drop(len(rows))
+
+	// Server errors are not fixed by a new connection
+	var serverErr *mysql.MySQLError
+	if errors.As(err, &serverErr) {
+		logger.Error("Outcome sink insert failed", "table", s.table, "error", err)
+		return true
+	}
+	logger.Error("Outcome sink connection failed", "error", err)
+	return false
+}
+
+// rest waits outcomeRetry after a connection failure, or until Stop.
+func (s *outcomeSink) rest() {
+	t := time.NewTimer(outcomeRetry)
+	defer t.Stop()
+	select {
+	case <-t.C:
+	case <-s.ctx.Done():
+	}
+}
+
+// insertOutcomes builds the INSERT of rows.
+func insertOutcomes(table string, rows []*outcome) string {
+	var b strings.Builder
+	b.WriteString("INSERT INTO " + quoteIdentifier(table) +
+		" (message_id, operation, channel, status, http_status, timetoken, error, attempts, enqueued_at, finished_at) VALUES ")
+
+	nullable := func(s string) string {
+		if s == "" {
+			return "NULL"
+		}
+		return quoteString(s)
+	}
+
+	for i, o := range rows {
+		if i > 0 {
+			b.WriteString(",")
+		}
+		httpStatus := "NULL"
+		if o.HTTPStatus != 0 {
+			httpStatus = strconv.Itoa(o.HTTPStatus)
+		}
+		b.WriteString("(" + strings.Join([]string{
+			quoteString(o.ID),
+			quoteString(o.Operation),
+			quoteString(o.Channel),
+			quoteString(o.Status),
+			httpStatus,
+			nullable(o.Timetoken),
+			nullable(o.Error),
+			strconv.Itoa(o.Attempts),
+			quoteTime(o.Enqueued),
+			quoteTime(o.Finished),
+		}, ",") + ")")
+	}
+
+	return b.String()
+}
+
+// quoteString returns s as an utf8mb4 hex literal, safe in any sql_mode
+// and character set of the connection.
+func quoteString(s string) string {
+	if s == "" {
+		return "''"
+	}
+	return "_utf8mb4 X'" + hex.EncodeToString([]byte(s)) + "'"
+}
+
+// quoteIdentifier quotes a table or column name, "db.table" is quoted as
+// two identifiers.
+func quoteIdentifier(name string) string {
+	parts := strings.Split(name, ".")
+	for i, part := range parts {
+		parts[i] = "`" + strings.Replace(part, "`", "``", -1) + "`"
+	}
+	return strings.Join(parts, ".")
+}
+
+// quoteTime returns t as a DATETIME(6) literal in UTC.
+func quoteTime(t time.Time) string {
+	return "'" + t.UTC().Format("2006-01-02 15:04:05.000000") + "'"
+}
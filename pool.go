@@ -1,33 +1,223 @@
 package main
 
-type (
-	pool struct {
-		size int
-		conn chan interface{}
-	}
-	poolInitFn func() (interface{}, error)
+import (
+	"container/list"
+	"context"
+	"sync"
 )
 
-func (p *pool) InitPool(size int, initfn poolInitFn) error {
-	// Create a buffered channel allowing size senders
-	p.conn = make(chan interface{}, size)
+// pool lends items to one user at a time. Missing items are created on
+// acquire, so a pool whose init failed fills up once newItem succeeds.
+type pool[T comparable] struct {
+	mu          sync.Mutex
+	size        int // Target number of items
+	total       int // Items created, being created or granted to a waiter, and not discarded
+	idle        []T
+	failures    map[T]int  // Consecutive failures by item
+	maxFailures int        // Failures before an item is discarded, 0 never
+	waiters     *list.List // Of chan handoff[T], oldest first
+
+	newItem   func() (T, error)
+	closeItem func(T) // Called on discarded items, may be nil
+}
+
+// handoff is a released item given to a waiting acquire, or the right to
+// create one when create is set.
+type handoff[T comparable] struct {
+	item   T
+	create bool
+}
+
+// newPool creates a pool of size items, the pool is usable even when an
+// item fails to be created.
+func newPool[T comparable](size, maxFailures int, newItem func() (T, error), closeItem func(T)) (*pool[T], error) {
+	p := &pool[T]{
+		size:        size,
+		failures:    make(map[T]int),
+		maxFailures: maxFailures,
+		waiters:     list.New(),
+		newItem:     newItem,
+		closeItem:   closeItem,
+	}
+
 	for x := 0; x < size; x++ {
-		conn, err := initfn()
+		item, err := newItem()
 		if err != nil {
-			return err
+			return p, err
 		}
+		p.idle = append(p.idle, item)
+		p.total++
+	}
+	return p, nil
+}
+
+// Acquire returns an idle item, creates one when the pool is not full or
+// waits for a release until ctx is done. Waiters are served in order, each
+// release wakes up one of them.
+func (p *pool[T]) Acquire(ctx context.Context) (T, error) {
+	p.mu.Lock()
+	if item, ok, create := p.take(); ok {
+		p.mu.Unlock()
+		return item, nil
+	} else if create {
+		p.mu.Unlock()
+		return p.create()
+	}
+
+	wait := make(chan handoff[T], 1)
+	e := p.waiters.PushBack(wait)
+	p.mu.Unlock()
+
+	select {
+	case h := <-wait:
+		if h.create {
+			return p.create()
+		}
+		return h.item, nil
+	case <-ctx.Done():
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.waiters.Remove(e)
+	select {
+	case h := <-wait:
+		// Handed off meanwhile, give it to the next waiter
+		p.put(h)
+	default:
+	}
+	var zero T
+	return zero, ctx.Err()
+}
+
+// TryAcquire is Acquire without waiting, ok is false when every item is
+// in use.
+func (p *pool[T]) TryAcquire() (item T, ok bool, err error) {
+	p.mu.Lock()
+	item, ok, create := p.take()
+	p.mu.Unlock()
+	if ok || !create {
+		return item, ok, nil
+	}
+	item, err = p.create()
+	return item, err == nil, err
+}
+
+// Put returns an acquired item unused, its failures are unchanged.
+func (p *pool[T]) Put(item T) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.put(handoff[T]{item: item})
+}
+
+// Release returns an item to the pool, ok is false after a failure of the
+// item. It returns true when the item was discarded after maxFailures
+// consecutive failures, the next acquire creates its replacement.
+func (p *pool[T]) Release(item T, ok bool) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
 
-		// If the init function succeeded, add the connection to the channel
-		p.conn <- conn
+	if ok {
+		delete(p.failures, item)
+	} else {
+		p.failures[item]++
 	}
+
+	failed := p.maxFailures > 0 && p.failures[item] >= p.maxFailures
+	if failed || p.total > p.size {
+		p.discard(item)
+		p.grow()
+		return failed
+	}
+
+	p.put(handoff[T]{item: item})
+	return false
+}
+
+// Resize changes the number of items, extra idle items are discarded now
+// and items in use on release.
+func (p *pool[T]) Resize(size int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
 	p.size = size
-	return nil
+	for p.total > p.size && len(p.idle) > 0 {
+		item := p.idle[len(p.idle)-1]
+		p.idle = p.idle[:len(p.idle)-1]
+		p.discard(item)
+	}
+	p.grow()
+}
+
+// Size returns the target number of items.
+func (p *pool[T]) Size() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.size
+}
+
+// InUse returns the number of items checked out.
+func (p *pool[T]) InUse() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.total - len(p.idle)
+}
+
+// take pops an idle item, or reserves the creation of one when create is
+// set, p.mu is held.
+func (p *pool[T]) take() (item T, ok bool, create bool) {
+	if n := len(p.idle); n > 0 {
+		item = p.idle[n-1]
+		p.idle = p.idle[:n-1]
+		return item, true, false
+	}
+	if p.total < p.size {
+		p.total++
+		return item, false, true
+	}
+	return item, false, false
+}
+
+// create makes a reserved item, a failed creation passes the reservation
+// to the next waiter.
+func (p *pool[T]) create() (T, error) {
+	item, err := p.newItem()
+	if err != nil {
+		p.mu.Lock()
+		p.total--
+		p.grow()
+		p.mu.Unlock()
+	}
+	return item, err
 }
 
-func (p *pool) GetConnection() interface{} {
-	return <-p.conn
+// put gives an item or a creation right to the oldest waiter, or keeps it
+// idle, p.mu is held.
+func (p *pool[T]) put(h handoff[T]) {
+	if e := p.waiters.Front(); e != nil {
+		p.waiters.Remove(e)
+		e.Value.(chan handoff[T]) <- h
+		return
+	}
+	if h.create {
+		p.total--
+		return
+	}
+	p.idle = append(p.idle, h.item)
+}
+
+// grow lets waiters create the missing items, p.mu is held.
+func (p *pool[T]) grow() {
+	for p.total < p.size && p.waiters.Len() > 0 {
+		p.total++
+		p.put(handoff[T]{create: true})
+	}
 }
 
-func (p *pool) ReleaseConnection(conn interface{}) {
-	p.conn <- conn
+func (p *pool[T]) discard(item T) {
+	p.total--
+	delete(p.failures, item)
+	if p.closeItem != nil {
+		p.closeItem(item)
+	}
 }
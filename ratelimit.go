@@ -0,0 +1,165 @@
+package main
+
+import (
+	"errors"
+	"path"
+	"sync"
+	"time"
+)
+
+// Rate limit policies
+const (
+	rateLimitDelay = "delay" // Keep excess messages queued until a token is available
+	rateLimitDrop  = "drop"  // Drop excess messages
+)
+
+// rateLimitMaxBuckets is the number of channel buckets above which the
+// full ones are forgotten, a full bucket is the same as a new one.
+const rateLimitMaxBuckets = 10000
+
+// rateLimitMaxSkipped is the number of messages held back by their channel
+// limit after which a dispatch stops walking the queue.
+const rateLimitMaxSkipped = 1000
+
+var errRateLimited = errors.New("rate limited")
+
+type (
+	// rateLimit configures a token bucket.
+	rateLimit struct {
+		Rate  float64 `json:"rate"`  // Messages per second, 0 is unlimited
+		Burst int     `json:"burst"` // Messages sent at once, rate rounded up when 0
+	}
+
+	// tokenBucket holds up to burst tokens, refilled at rate per second.
+	tokenBucket struct {
+		rate   float64
+		burst  float64
+		tokens float64
+		last   time.Time
+	}
+
+	// rateLimiter applies a global bucket and a bucket by channel, from the
+	// longest channel pattern matching it.
+	rateLimiter struct {
+		mu       sync.Mutex
+		global   *tokenBucket // nil when unlimited
+		patterns map[string]rateLimit
+		channels map[string]*tokenBucket // nil entries for unlimited channels
+	}
+)
+
+// newRateLimiter returns a limiter, nil without any limit.
+func newRateLimiter(global rateLimit, patterns map[string]rateLimit) *rateLimiter {
+	l := &rateLimiter{
+		global:   newTokenBucket(global),
+		patterns: make(map[string]rateLimit),
+		channels: make(map[string]*tokenBucket),
+	}
+	for pattern, limit := range patterns {
+		if limit.Rate > 0 {
+			l.patterns[pattern] = limit
+		}
+	}
+
+	if l.global == nil && len(l.patterns) == 0 {
+		return nil
+	}
+	return l
+}
+
+// checkChannelPattern returns the syntax error of a channel_rate_limits
+// pattern.
+func checkChannelPattern(pattern string) error {
+	_, err := path.Match(pattern, "")
+	return err
+}
+
+// newTokenBucket returns a full bucket, nil when limit is unlimited.
+func newTokenBucket(limit rateLimit) *tokenBucket {
+	if limit.Rate <= 0 {
+		return nil
+	}
+	burst := float64(limit.Burst)
+	if burst < 1 {
+		burst = float64(int(limit.Rate + 0.999))
+		if burst < 1 {
+			burst = 1
+		}
+	}
+	return &tokenBucket{rate: limit.Rate, burst: burst, tokens: burst}
+}
+
+// refill adds the tokens earned since the last call.
+func (b *tokenBucket) refill(now time.Time) {
+	if b == nil {
+		return
+	}
+	if !b.last.IsZero() && now.After(b.last) {
+		b.tokens += now.Sub(b.last).Seconds() * b.rate
+		if b.tokens > b.burst {
+			b.tokens = b.burst
+		}
+	}
+	b.last = now
+}
+
+func (b *tokenBucket) ready() bool { return b == nil || b.tokens >= 1 }
+
+func (b *tokenBucket) take() {
+	if b != nil {
+		b.tokens--
+	}
+}
+
+func (b *tokenBucket) full() bool { return b == nil || b.tokens >= b.burst }
+
+// Allow takes a token of the global bucket and of the channel bucket, it
+// returns false, taking none, when one of them is empty.
+func (l *rateLimiter) Allow(channel string, now time.Time) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	b, ok := l.channels[channel]
+	if !ok {
+		b = l.bucketFor(channel, now)
+		l.channels[channel] = b
+	}
+
+	l.global.refill(now)
+	b.refill(now)
+	if !l.global.ready() || !b.ready() {
+		return false
+	}
+	l.global.take()
+	b.take()
+	return true
+}
+
+// Exhausted is true when the global bucket is empty, no message can be
+// allowed until it refills.
+func (l *rateLimiter) Exhausted(now time.Time) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.global.refill(now)
+	return !l.global.ready()
+}
+
+// bucketFor creates the bucket of a channel, l.mu is held.
+func (l *rateLimiter) bucketFor(channel string, now time.Time) *tokenBucket {
+	if len(l.channels) >= rateLimitMaxBuckets {
+		for c, b := range l.channels {
+			if b.refill(now); b.full() {
+				delete(l.channels, c)
+			}
+		}
+	}
+
+	var found rateLimit
+	length := -1
+	for pattern, limit := range l.patterns {
+		if matched, _ := path.Match(pattern, channel); matched && len(pattern) > length {
+			found, length = limit, len(pattern)
+		}
+	}
+	return newTokenBucket(found)
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"reflect"
+	"unicode/utf8"
+)
+
+// schema is the subset of JSON Schema used to validate published messages:
+// type, enum, properties, required, additionalProperties, items and the
+// numeric, string and array bounds.
+type schema struct {
+	Type                 interface{}        `json:"type"` // string or list of strings
+	Enum                 []interface{}      `json:"enum"`
+	Properties           map[string]*schema `json:"properties"`
+	Required             []string           `json:"required"`
+	AdditionalProperties *bool              `json:"additionalProperties"`
+	Items                *schema            `json:"items"`
+	Minimum              *float64           `json:"minimum"`
+	Maximum              *float64           `json:"maximum"`
+	MinLength            *int               `json:"minLength"`
+	MaxLength            *int               `json:"maxLength"`
+	MinItems             *int               `json:"minItems"`
+	MaxItems             *int               `json:"maxItems"`
+}
+
+// decodeJSON decodes a single json value keeping numbers as json.Number.
+func decodeJSON(data []byte) (interface{}, error) {
+	var v interface{}
+	d := json.NewDecoder(bytes.NewReader(data))
+	d.UseNumber()
+	if err := d.Decode(&v); err != nil {
+		return nil, err
+	}
+	// More is false before a closing delimiter, decode it instead
+	var extra interface{}
+	if err := d.Decode(&extra); err != io.EOF {
+		return nil, fmt.Errorf("unexpected data after json value")
+	}
+	return v, nil
+}
+
+func compileSchema(data []byte) (*schema, error) {
+	var s *schema
+	d := json.NewDecoder(bytes.NewReader(data))
+	d.UseNumber()
+	if err := d.Decode(&s); err != nil {
+		return nil, err
+	}
+	if s == nil {
+		return nil, fmt.Errorf("empty schema")
+	}
+	return s, nil
+}
+
+// Validate checks a value returned by decodeJSON against the schema.
+func (s *schema) Validate(v interface{}) error {
+	return s.validate(v, "$")
+}
+
+func (s *schema) validate(v interface{}, path string) error {
+	if s == nil {
+		return nil
+	}
+
+	if s.Type != nil && !s.hasType(v) {
+		return fmt.Errorf("%s: expected %v got %s", path, s.Type, typeOf(v))
+	}
+
+	if s.Enum != nil {
+		found := false
+		for _, e := range s.Enum {
+			if jsonEqual(e, v) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("%s: value not in enum", path)
+		}
+	}
+
+	switch value := v.(type) {
+	case map[string]interface{}:
+		for _, name := range s.Required {
+			if _, ok := value[name]; !ok {
+				return fmt.Errorf("%s: missing required property %q", path, name)
+			}
+		}
+		for name, field := range value {
+			prop, ok := s.Properties[name]
+			if !ok {
+				if s.AdditionalProperties != nil && !*s.AdditionalProperties {
+					return fmt.Errorf("%s: unexpected property %q", path, name)
+				}
+				continue
+			}
+			if err := prop.validate(field, path+"."+name); err != nil {
+				return err
+			}
+		}
+
+	case []interface{}:
+		if s.MinItems != nil && len(value) < *s.MinItems {
+			return fmt.Errorf("%s: less than %d items", path, *s.MinItems)
+		}
+		if s.MaxItems != nil && len(value) > *s.MaxItems {
+			return fmt.Errorf("%s: more than %d items", path, *s.MaxItems)
+		}
+		for i, item := range value {
+			if err := s.Items.validate(item, fmt.Sprintf("%s[%d]", path, i)); err != nil {
+				return err
+			}
+		}
+
+	case string:
+		l := utf8.RuneCountInString(value)
+		if s.MinLength != nil && l < *s.MinLength {
+			return fmt.Errorf("%s: shorter than %d", path, *s.MinLength)
+		}
+		if s.MaxLength != nil && l > *s.MaxLength {
+			return fmt.Errorf("%s: longer than %d", path, *s.MaxLength)
+		}
+
+	case json.Number:
+		f, _ := value.Float64()
+		if s.Minimum != nil && f < *s.Minimum {
+			return fmt.Errorf("%s: less than %v", path, *s.Minimum)
+		}
+		if s.Maximum != nil && f > *s.Maximum {
+			return fmt.Errorf("%s: greater than %v", path, *s.Maximum)
+		}
+	}
+
+	return nil
+}
+
+func (s *schema) hasType(v interface{}) bool {
+	var types []interface{}
+	switch t := s.Type.(type) {
+	case string:
+		types = []interface{}{t}
+	case []interface{}:
+		types = t
+	}
+
+	actual := typeOf(v)
+	for _, t := range types {
+		if t == actual || (t == "number" && actual == "integer") {
+			return true
+		}
+	}
+	return false
+}
+
+func typeOf(v interface{}) string {
+	switch value := v.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case string:
+		return "string"
+	case []interface{}:
+		return "array"
+	case map[string]interface{}:
+		return "object"
+	case json.Number:
+		f, err := value.Float64()
+		if err == nil && f == math.Trunc(f) {
+			return "integer"
+		}
+		return "number"
+	}
+	return "unknown"
+}
+
+func jsonEqual(a, b interface{}) bool {
+	na, ok := a.(json.Number)
+	nb, ok2 := b.(json.Number)
+	if ok && ok2 {
+		fa, _ := na.Float64()
+		fb, _ := nb.Float64()
+		return fa == fb
+	}
+	return reflect.DeepEqual(a, b)
+}
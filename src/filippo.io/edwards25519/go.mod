@@ -0,0 +1,3 @@
+module filippo.io/edwards25519
+
+go 1.24.0
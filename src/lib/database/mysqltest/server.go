@@ -0,0 +1,338 @@
+// Package mysqltest provides a fake MySQL server for hermetic tests.
+//
+// The server authenticates one user with mysql_native_password or
+// caching_sha2_password, fast or full with an RSA key, records the
+// statements it receives and answers them with OK packets, or with errors
+// injected by Fail.
+package mysqltest
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+)
+
+// Authentication plugins
+const (
+	NativePassword      = "mysql_native_password"
+	CachingSHA2Password = "caching_sha2_password"
+)
+
+// Server is a fake MySQL server listening on 127.0.0.1.
+type Server struct {
+	User     string
+	Password string
+
+	ln     net.Listener
+	plugin string
+	key    *rsa.PrivateKey // caching_sha2_password full authentication, nil for the fast path
+	mu     sync.Mutex
+	conns  map[net.Conn]bool
+	stmts  []string
+	fails  []fail
+	wg     sync.WaitGroup
+}
+
+type fail struct {
+	code    uint16
+	message string
+}
+
+// NewServer starts a server accepting user and password.
+func NewServer(user, password string) *Server {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		panic(fmt.Sprintf("mysqltest: failed to listen: %v", err))
+	}
+
+	s := &Server{
+		User:     user,
+		Password: password,
+		plugin:   NativePassword,
+		ln:       ln,
+		conns:    make(map[net.Conn]bool),
+	}
+
+	s.wg.Add(1)
+	go s.serve()
+	return s
+}
+
+// Addr returns the host:port of the server.
+func (s *Server) Addr() string {
+	return s.ln.Addr().String()
+}
+
+// DSN returns a data source name for dbname.
+func (s *Server) DSN(dbname string) string {
+	return s.User + ":" + s.Password + "@tcp(" + s.Addr() + ")/" + dbname
+}
+
+// SetPlugin sets the authentication plugin of new connections,
+// NativePassword by default.
+func (s *Server) SetPlugin(plugin string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.plugin = plugin
+}
+
+// SetFullAuth makes caching_sha2_password connections use the full
+// authentication, the password is decrypted with key.
+func (s *Server) SetFullAuth(key *rsa.PrivateKey) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.key = key
+}
+
+// PublicKeyPEM returns the PEM encoded public key of the full
+// authentication key.
+func (s *Server) PublicKeyPEM() []byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	der, err := x509.MarshalPKIXPublicKey(&s.key.PublicKey)
+	if err != nil {
+		panic(fmt.Sprintf("mysqltest: %v", err))
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})
+}
+
+// Statements returns the statements received.
+func (s *Server) Statements() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.stmts...)
+}
+
+// Fail answers the next count statements with an error.
+func (s *Server) Fail(count int, code uint16, message string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := 0; i < count; i++ {
+		s.fails = append(s.fails, fail{code, message})
+	}
+}
+
+// CloseConnections drops the client connections, as a server restart.
+func (s *Server) CloseConnections() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for c := range s.conns {
+		c.Close()
+	}
+}
+
+// Close stops the server.
+func (s *Server) Close() {
+	s.ln.Close()
+	s.CloseConnections()
+	s.wg.Wait()
+}
+
+func (s *Server) serve() {
+	defer s.wg.Done()
+	for {
+		c, err := s.ln.Accept()
+		if err != nil {
+			return
+		}
+		s.mu.Lock()
+		s.conns[c] = true
+		s.mu.Unlock()
+
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			s.handle(&conn{Conn: c, r: bufio.NewReader(c)})
+			c.Close()
+			s.mu.Lock()
+			delete(s.conns, c)
+			s.mu.Unlock()
+		}()
+	}
+}
+
+// conn reads and writes packets.
+type conn struct {
+	net.Conn
+	r   *bufio.Reader
+	seq byte
+}
+
+func (c *conn) read() ([]byte, error) {
+	var header [4]byte
+	if _, err := io.ReadFull(c.r, header[:]); err != nil {
+		return nil, err
+	}
+	data := make([]byte, int(header[0])|int(header[1])<<8|int(header[2])<<16)
+	if _, err := io.ReadFull(c.r, data); err != nil {
+		return nil, err
+	}
+	c.seq = header[3] + 1
+	return data, nil
+}
+
+func (c *conn) write(data []byte) error {
+	header := []byte{byte(len(data)), byte(len(data) >> 8), byte(len(data) >> 16), c.seq}
+	c.seq++
+	_, err := c.Write(append(header, data...))
+	return err
+}
+
+func (c *conn) ok(affected int) error {
+	return c.write([]byte{0x00, byte(affected), 0x00, 0x02, 0x00, 0x00, 0x00})
+}
+
+func (c *conn) error(code uint16, state, message string) error {
+	b := []byte{0xff, byte(code), byte(code >> 8), '#'}
+	return c.write(append(append(b, state...), message...))
+}
+
+func (s *Server) handle(c *conn) {
+	scramble := make([]byte, 20)
+	rand.Read(scramble)
+	for i := range scramble {
+		// No 0 in the scramble
+		scramble[i] = scramble[i]%127 + 1
+	}
+
+	s.mu.Lock()
+	plugin, key := s.plugin, s.key
+	s.mu.Unlock()
+
+	// Protocol 10 greeting
+	g := []byte{10}
+	g = append(g, "8.0.0-mysqltest\x00"...)
+	g = append(g, 1, 0, 0, 0)
+	g = append(g, scramble[:8]...)
+	g = append(g, 0)
+	g = append(g, 0xff, 0xf7) // Capabilities, protocol 4.1 and secure connection
+	g = append(g, 45, 0x02, 0x00)
+	g = append(g, 0xff, 0x81) // Capabilities, plugin auth
+	g = append(g, 21)
+	g = append(g, make([]byte, 10)...)
+	g = append(g, scramble[8:]...)
+	g = append(g, 0)
+	g = append(g, plugin...)
+	g = append(g, 0)
+	if c.write(g) != nil {
+		return
+	}
+
+	// Handshake response
+	data, err := c.read()
+	if err != nil || len(data) < 32 {
+		return
+	}
+	data = data[32:]
+	end := bytes.IndexByte(data, 0)
+	if end < 0 {
+		return
+	}
+	user := string(data[:end])
+	data = data[end+1:]
+	if len(data) == 0 || int(data[0]) >= len(data) {
+		return
+	}
+	auth := data[1 : 1+int(data[0])]
+
+	if user != s.User || !bytes.Equal(auth, scramblePassword(plugin, scramble, s.Password)) {
+		c.error(1045, "28000", fmt.Sprintf("Access denied for user '%s'", user))
+		return
+	}
+	if plugin == CachingSHA2Password && s.Password != "" && key != nil {
+		// Full authentication, the public key is requested with 0x02
+		if c.write([]byte{0x01, 0x04}) != nil {
+			return
+		}
+		data, err := c.read()
+		if err != nil {
+			return
+		}
+		if len(data) == 1 && data[0] == 0x02 {
+			if c.write(append([]byte{0x01}, s.PublicKeyPEM()...)) != nil {
+				return
+			}
+			if data, err = c.read(); err != nil {
+				return
+			}
+		}
+		plain, err := rsa.DecryptOAEP(sha1.New(), nil, key, data, nil)
+		for i := range plain {
+			plain[i] ^= scramble[i%len(scramble)]
+		}
+		if err != nil || string(plain) != s.Password+"\x00" {
+			c.error(1045, "28000", fmt.Sprintf("Access denied for user '%s'", user))
+			return
+		}
+	} else if plugin == CachingSHA2Password && s.Password != "" {
+		// Fast authentication
+		if c.write([]byte{0x01, 0x03}) != nil {
+			return
+		}
+	}
+	if c.ok(0) != nil {
+		return
+	}
+
+	for {
+		data, err := c.read()
+		if err != nil || len(data) == 0 {
+			return
+		}
+		switch data[0] {
+		case 0x01: // COM_QUIT
+			return
+		case 0x03: // COM_QUERY
+			stmt := string(data[1:])
+			s.mu.Lock()
+			s.stmts = append(s.stmts, stmt)
+			var f *fail
+			if len(s.fails) > 0 {
+				f = &s.fails[0]
+				s.fails = s.fails[1:]
+			}
+			s.mu.Unlock()
+
+			if f != nil {
+				c.error(f.code, "HY000", f.message)
+			} else {
+				c.ok(strings.Count(stmt, "),(") + 1)
+			}
+		default:
+			c.error(1047, "08S01", "Unknown command")
+		}
+	}
+}
+
+func scramblePassword(plugin string, scramble []byte, password string) []byte {
+	if password == "" {
+		return []byte{}
+	}
+	if plugin == CachingSHA2Password {
+		stage1 := sha256.Sum256([]byte(password))
+		stage2 := sha256.Sum256(stage1[:])
+		h := sha256.Sum256(append(stage2[:], scramble...))
+		for i := range h {
+			h[i] ^= stage1[i]
+		}
+		return h[:]
+	}
+
+	stage1 := sha1.Sum([]byte(password))
+	stage2 := sha1.Sum(stage1[:])
+	h := sha1.Sum(append(append([]byte(nil), scramble...), stage2[:]...))
+	for i := range h {
+		h[i] ^= stage1[i]
+	}
+	return h[:]
+}
@@ -1,44 +1,42 @@
 package pubnub
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"net/url"
 	"strings"
-	"time"
-
-	"log"
 )
 
 func (pub *Pubnub) Audit(channel string, authkey string) (*AuditResponse, error) {
+	return pub.AuditContext(context.Background(), channel, authkey)
+}
 
-	params := ""
+// AuditContext is Audit aborted when ctx is done.
+func (pub *Pubnub) AuditContext(ctx context.Context, channel string, authkey string) (*AuditResponse, error) {
+
+	query := url.Values{}
 
 	authkey = strings.TrimSpace(authkey)
 	if authkey != "" {
-		params += "auth=" + authkey + "&"
+		query.Set("auth", authkey)
 	}
 
 	channel = strings.TrimSpace(channel)
 	if channel != "" {
-		params += "channel=" + url.QueryEscape(channel) + "&"
+		query.Set("channel", channel)
 	}
 
-	params += "timestamp=" + fmt.Sprintf("%d", time.Now().Unix())
-
-	// Sign request
-	signature := getHmacSha256(
-		pub.secretKey,
-		pub.subscribeKey+"\n"+pub.publishKey+"\naudit\n"+params,
-	)
-
-	request := "/v1/auth/audit/sub-key/" + pub.subscribeKey + "?" + params + "&signature=" + signature
-	value, _, err := pub.httpRequest(request, false)
+	path := "/v2/auth/audit/sub-key/" + pub.subscribeKey
+	value, responseCode, err := pub.httpRequest(ctx, pub.signedURL(ctx, "GET", path, query, nil), false)
 
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("PAM Error Internal: %w", err)
+	}
+	if responseCode != 200 {
+		return nil, newAPIError(responseCode, value)
 	}
-	log.Printf("Audit %s", value)
+	pub.log(LevelDebug, "Audit response", "body", string(value))
 	var response *AuditResponse
 	err = json.Unmarshal([]byte(value), &response)
 	if err != nil {
@@ -1,46 +1,41 @@
 package pubnub
 
 import (
-	"sync"
 	"testing"
-)
 
-var pubnub = Pubnub{
-	origin:              "https://pubsub.pubnub.com",
-	publishKey:          "pub-c-82403925-3c5f-466f-a67b-8faef7d9492d",
-	subscribeKey:        "sub-c-57712b5e-05ae-11e4-aac6-02ee2ddab7fe",
-	secretKey:           "sec-c-NjM3NDgyYjEtYjY2Zi00N2I5LThmMWEtN2I2MjFkZTY1ZTY2",
-	connectRetry:        3,
-	connectTimeout:      10,
-	subscribeTimeout:    310,
-	nonSubscribeTimeout: 5,
-}
+	"lib/net/http/pubnub/pubnubtest"
+)
 
-func TestGrant(t *testing.T) {
+func TestAudit(t *testing.T) {
+	pubnub, _ := newTestPubnub(t)
 
-	request := func(wg *sync.WaitGroup, t *testing.T) {
-		defer wg.Done()
-		response, err := pubnub.Grant("console", "auth_AAA", true, true, 1700)
-		if err != nil {
-			t.Errorf("Grant %s", err)
-		}
-		t.Logf("res %v", response)
+	if _, err := pubnub.Grant("console", "auth_AAA", true, false, 60); err != nil {
+		t.Fatalf("Grant %s", err)
+	}
+	if _, err := pubnub.Grant("console", "auth_BBB", true, true, 1440); err != nil {
+		t.Fatalf("Grant %s", err)
 	}
 
-	wg := &sync.WaitGroup{}
-	for i := 1; i < 10; i++ {
-		wg.Add(1)
-		go request(wg, t)
+	response, err := pubnub.Audit("console", "")
+	if err != nil {
+		t.Fatalf("Audit %s", err)
+	}
+	if len(response.Payload.Channels["console"].Auths) != 2 {
+		t.Errorf("Expected 2 auths got %+v", response.Payload)
+	}
+	if ttl := response.GetMaxTTL("console"); ttl != 1440 {
+		t.Errorf("Expected max ttl 1440 got %d", ttl)
+	}
+	if ttl := response.GetMaxTTL("missing"); ttl != 0 {
+		t.Errorf("Expected max ttl 0 got %d", ttl)
 	}
-	wg.Wait()
-	t.Logf("Done")
 }
 
-func zTestAst(t *testing.T) {
-	response, err := pubnub.SubKey("ttasdsad", "apns", "b5f5bd50-d8c9-4773-973f-a9c710e9dba9")
-	if err != nil {
-		t.Errorf("SubKey %s", err)
-		return
+func TestAuditMalformed(t *testing.T) {
+	pubnub, srv := newTestPubnub(t)
+
+	srv.Inject(pubnubtest.Malformed, 1)
+	if _, err := pubnub.Audit("console", ""); err == nil {
+		t.Errorf("Expected error for malformed response")
 	}
-	t.Logf("res %s", response)
 }
@@ -0,0 +1,213 @@
+package pubnub
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+)
+
+// Minimal CBOR (RFC 7049) decoder for PAM v3 tokens. Maps are decoded to
+// map[string]interface{}, integers to int64, byte strings to []byte.
+
+var errCBORTruncated = errors.New("pubnub: truncated cbor data")
+
+type cborDecoder struct {
+	data []byte
+	pos  int
+}
+
+func decodeCBOR(data []byte) (interface{}, error) {
+	d := &cborDecoder{data: data}
+	v, err := d.value(0)
+	if err != nil {
+		return nil, err
+	}
+	if d.pos != len(d.data) {
+		return nil, fmt.Errorf("pubnub: %d bytes after cbor value", len(d.data)-d.pos)
+	}
+	return v, nil
+}
+
+func (d *cborDecoder) next(n int) ([]byte, error) {
+	if n < 0 || n > len(d.data)-d.pos {
+		return nil, errCBORTruncated
+	}
+	b := d.data[d.pos : d.pos+n]
+	d.pos += n
+	return b, nil
+}
+
+// argument reads the additional information of an item header.
+func (d *cborDecoder) argument(info byte) (uint64, error) {
+	switch {
+	case info < 24:
+		return uint64(info), nil
+	case info == 24:
+		b, err := d.next(1)
+		if err != nil {
+			return 0, err
+		}
+		return uint64(b[0]), nil
+	case info == 25:
+		b, err := d.next(2)
+		if err != nil {
+			return 0, err
+		}
+		return uint64(binary.BigEndian.Uint16(b)), nil
+	case info == 26:
+		b, err := d.next(4)
+		if err != nil {
+			return 0, err
+		}
+		return uint64(binary.BigEndian.Uint32(b)), nil
+	case info == 27:
+		b, err := d.next(8)
+		if err != nil {
+			return 0, err
+		}
+		return binary.BigEndian.Uint64(b), nil
+	}
+	return 0, fmt.Errorf("pubnub: unsupported cbor length %d", info)
+}
+
+func (d *cborDecoder) value(depth int) (interface{}, error) {
+	if depth > 32 {
+		return nil, errors.New("pubnub: cbor nesting too deep")
+	}
+
+	header, err := d.next(1)
+	if err != nil {
+		return nil, err
+	}
+	major, info := header[0]>>5, header[0]&0x1f
+
+	// Floats and simple values carry their payload in the argument
+	if major == 7 {
+		return d.simple(info)
+	}
+
+	arg, err := d.argument(info)
+	if err != nil {
+		return nil, err
+	}
+
+	switch major {
+	case 0:
+		if arg > math.MaxInt64 {
+			return nil, errors.New("pubnub: cbor integer overflow")
+		}
+		return int64(arg), nil
+	case 1:
+		if arg > math.MaxInt64 {
+			return nil, errors.New("pubnub: cbor integer overflow")
+		}
+		return -1 - int64(arg), nil
+	case 2:
+		b, err := d.next(int(arg))
+		if err != nil {
+			return nil, err
+		}
+		return append([]byte(nil), b...), nil
+	case 3:
+		b, err := d.next(int(arg))
+		if err != nil {
+			return nil, err
+		}
+		return string(b), nil
+	case 4:
+		if arg > uint64(len(d.data)) {
+			return nil, errCBORTruncated
+		}
+		list := make([]interface{}, 0, arg)
+		for i := uint64(0); i < arg; i++ {
+			v, err := d.value(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, v)
+		}
+		return list, nil
+	case 5:
+		if arg > uint64(len(d.data)) {
+			return nil, errCBORTruncated
+		}
+		m := make(map[string]interface{}, arg)
+		for i := uint64(0); i < arg; i++ {
+			k, err := d.value(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			v, err := d.value(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			switch key := k.(type) {
+			case string:
+				m[key] = v
+			case []byte:
+				m[string(key)] = v
+			default:
+				m[fmt.Sprint(key)] = v
+			}
+		}
+		return m, nil
+	case 6:
+		// Tags are ignored
+		return d.value(depth + 1)
+	}
+
+	return nil, fmt.Errorf("pubnub: unsupported cbor type %d", major)
+}
+
+func (d *cborDecoder) simple(info byte) (interface{}, error) {
+	switch info {
+	case 20:
+		return false, nil
+	case 21:
+		return true, nil
+	case 22, 23:
+		return nil, nil
+	case 25:
+		b, err := d.next(2)
+		if err != nil {
+			return nil, err
+		}
+		return halfFloat(binary.BigEndian.Uint16(b)), nil
+	case 26:
+		b, err := d.next(4)
+		if err != nil {
+			return nil, err
+		}
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(b))), nil
+	case 27:
+		b, err := d.next(8)
+		if err != nil {
+			return nil, err
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(b)), nil
+	}
+	return nil, fmt.Errorf("pubnub: unsupported cbor simple value %d", info)
+}
+
+func halfFloat(h uint16) float64 {
+	exp := int(h>>10) & 0x1f
+	mant := float64(h & 0x3ff)
+	var v float64
+	switch exp {
+	case 0:
+		v = math.Ldexp(mant, -24)
+	case 31:
+		if mant == 0 {
+			v = math.Inf(1)
+		} else {
+			v = math.NaN()
+		}
+	default:
+		v = math.Ldexp(mant+1024, exp-25)
+	}
+	if h&0x8000 != 0 {
+		return -v
+	}
+	return v
+}
@@ -0,0 +1,115 @@
+package pubnub
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"syscall"
+)
+
+// Error classes, test with errors.Is
+var (
+	ErrAuth       = errors.New("pubnub: not authorized")    // 401 and 403
+	ErrQuota      = errors.New("pubnub: too many requests") // 429
+	ErrValidation = errors.New("pubnub: invalid request")   // 400, 413 and 414
+)
+
+// APIError is a non 200 response of PubNub.
+type APIError struct {
+	Status    int    // HTTP status
+	Service   string // PubNub service, eg. "Access Manager"
+	Message   string // PubNub message or response body
+	Retryable bool   // The request may succeed later
+}
+
+func (e *APIError) Error() string {
+	if e.Service != "" {
+		return fmt.Sprintf("pubnub: %s %d: %s", e.Service, e.Status, e.Message)
+	}
+	return fmt.Sprintf("pubnub: %d: %s", e.Status, e.Message)
+}
+
+// Is matches the error classes.
+func (e *APIError) Is(target error) bool {
+	switch target {
+	case ErrAuth:
+		return e.Status == http.StatusUnauthorized || e.Status == http.StatusForbidden
+	case ErrQuota:
+		return e.Status == http.StatusTooManyRequests
+	case ErrValidation:
+		return e.Status == http.StatusBadRequest ||
+			e.Status == http.StatusRequestEntityTooLarge ||
+			e.Status == http.StatusRequestURITooLong
+	}
+	return false
+}
+
+// newAPIError builds the error of a non 200 response from its body.
+func newAPIError(status int, body []byte) *APIError {
+	e := &APIError{
+		Status:    status,
+		Message:   string(body),
+		Retryable: status == http.StatusTooManyRequests || status >= 500,
+	}
+
+	var response Response
+	if json.Unmarshal(body, &response) == nil && response.Message != "" {
+		e.Service = response.Service
+		e.Message = response.Message
+	}
+
+	return e
+}
+
+// Aborted reports whether err is the cancellation or the deadline of the
+// caller context, wrapped by the public methods. Transport timeouts also
+// match context.DeadlineExceeded but are not aborts.
+func Aborted(err error) bool {
+	var urlErr *url.Error
+	return (errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded)) &&
+		!errors.As(err, &urlErr)
+}
+
+// Retryable reports whether a failed request may succeed when sent again:
+// 429 and 5xx responses, timeouts, refused, reset or closed connections.
+// Requests cancelled or past the caller deadline, certificate and pin
+// failures or invalid settings are not retryable.
+func Retryable(err error) bool {
+	if err == nil || Aborted(err) {
+		return false
+	}
+
+	var apiErr *APIError
+	if errors.As(err, &apiErr) {
+		return apiErr.Retryable
+	}
+
+	// Transport errors, the caller context errors are not url errors
+	var urlErr *url.Error
+	if !errors.As(err, &urlErr) {
+		return false
+	}
+
+	// Sent again they fail the same way
+	var certErr *tls.CertificateVerificationError
+	var unknownAuthority x509.UnknownAuthorityError
+	var hostnameErr x509.HostnameError
+	var invalidErr x509.CertificateInvalidError
+	if errors.Is(err, ErrPinMismatch) || errors.As(err, &certErr) || errors.As(err, &unknownAuthority) ||
+		errors.As(err, &hostnameErr) || errors.As(err, &invalidErr) {
+		return false
+	}
+
+	// url.Error is a net.Error itself, only its cause tells
+	var netErr net.Error
+	return errors.As(urlErr.Err, &netErr) ||
+		errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF)
+}
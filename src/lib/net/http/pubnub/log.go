@@ -0,0 +1,62 @@
+package pubnub
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Level is the severity of a library message.
+type Level int
+
+// Levels
+const (
+	LevelDebug Level = iota // Responses and payloads
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+var levelNames = []string{"debug", "info", "warn", "error"}
+
+func (l Level) String() string {
+	if l < LevelDebug || l > LevelError {
+		return fmt.Sprintf("level(%d)", int(l))
+	}
+	return levelNames[l]
+}
+
+// ParseLevel converts a level name (debug, info, warn or error).
+func ParseLevel(name string) (Level, error) {
+	for i, n := range levelNames {
+		if strings.EqualFold(name, n) {
+			return Level(i), nil
+		}
+	}
+	return LevelInfo, fmt.Errorf("pubnub: unknown log level %q", name)
+}
+
+// LevelLogger is a Logger receiving the level and fields of the library
+// messages, fields are key and value pairs.
+type LevelLogger interface {
+	Logger
+	Log(level Level, msg string, kv ...interface{})
+}
+
+// log sends a message to the logger, a plain Logger only receives info
+// and higher levels with the fields appended as key=value.
+func (pub *Pubnub) log(level Level, msg string, kv ...interface{}) {
+	if l, ok := pub.logger.(LevelLogger); ok {
+		l.Log(level, msg, kv...)
+		return
+	}
+	if level < LevelInfo {
+		return
+	}
+
+	var b strings.Builder
+	b.WriteString(msg)
+	for i := 0; i+1 < len(kv); i += 2 {
+		fmt.Fprintf(&b, " %v=%v", kv[i], kv[i+1])
+	}
+	pub.logger.Printf("%s", b.String())
+}
@@ -0,0 +1,173 @@
+package pubnub
+
+import (
+	"crypto/rand"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// NewClient initializes a Pubnub instance from the keys and options.
+// Without options it uses SSL, the default origin, a generated uuid,
+// 3 retries, 10s connect, 5s request and 310s subscribe timeouts and
+// logs to the standard logger.
+func NewClient(publishKey string, subscribeKey string, options ...Option) *Pubnub {
+
+	pubnub := &Pubnub{
+		origin:                origin,
+		publishKey:            publishKey,
+		subscribeKey:          subscribeKey,
+		isSSL:                 true,
+		subscribedChannels:    "",
+		newSubscribedChannels: "",
+		connectRetry:          3,
+		connectTimeout:        10 * time.Second,
+		nonSubscribeTimeout:   5 * time.Second,
+		subscribeTimeout:      310 * time.Second,
+		logger:                log.Default(),
+		presenceChannels:      make(map[string]chan []byte),
+		subscribeChannels:     make(map[string]chan []byte),
+	}
+
+	for _, option := range options {
+		option(pubnub)
+	}
+
+	pubnub.origin = originURL(pubnub.origin, pubnub.isSSL)
+	if pubnub.uuid == "" {
+		pubnub.uuid = generateUUID()
+	}
+
+	return pubnub
+}
+
+// WithSecretKey sets the secret key used to sign requests.
+func WithSecretKey(secretKey string) Option {
+	return func(pub *Pubnub) {
+		pub.secretKey = secretKey
+	}
+}
+
+// WithCipherKey sets the cipher key.
+func WithCipherKey(cipherKey string) Option {
+	return func(pub *Pubnub) {
+		pub.cipherKey = cipherKey
+	}
+}
+
+// WithSSL selects the protocol of origins given without scheme.
+func WithSSL(sslOn bool) Option {
+	return func(pub *Pubnub) {
+		pub.isSSL = sslOn
+	}
+}
+
+// WithOrigin replaces the default origin with a host (ps.pndsn.com), a host and port,
+// or an url with scheme, port and path prefix (http://localhost:8080/pubnub).
+// Without scheme the protocol is selected by WithSSL.
+func WithOrigin(origin string) Option {
+	return func(pub *Pubnub) {
+		if origin != "" {
+			pub.origin = origin
+		}
+	}
+}
+
+// WithUUID sets the client uuid, one is generated when empty.
+func WithUUID(uuid string) Option {
+	return func(pub *Pubnub) {
+		pub.uuid = uuid
+	}
+}
+
+// WithConnectTimeout limits establishing a connection.
+func WithConnectTimeout(timeout time.Duration) Option {
+	return func(pub *Pubnub) {
+		pub.connectTimeout = timeout
+	}
+}
+
+// WithNonSubscribeTimeout limits a whole publish, grant or audit request.
+func WithNonSubscribeTimeout(timeout time.Duration) Option {
+	return func(pub *Pubnub) {
+		pub.nonSubscribeTimeout = timeout
+	}
+}
+
+// WithSubscribeTimeout limits a subscribe request.
+func WithSubscribeTimeout(timeout time.Duration) Option {
+	return func(pub *Pubnub) {
+		pub.subscribeTimeout = timeout
+	}
+}
+
+// WithRetry sets how many times a timed out request is retried.
+func WithRetry(retry int) Option {
+	return func(pub *Pubnub) {
+		pub.connectRetry = retry
+	}
+}
+
+// WithHTTPClient uses client for all requests, ignoring the timeouts,
+// TLS and proxy settings of the instance.
+func WithHTTPClient(client *http.Client) Option {
+	return func(pub *Pubnub) {
+		pub.client = client
+		pub.customClient = client != nil
+	}
+}
+
+// WithTransport uses transport for requests, ignoring the TLS, proxy
+// and connect timeout settings of the instance.
+func WithTransport(transport http.RoundTripper) Option {
+	return func(pub *Pubnub) {
+		pub.nonSubscribeTransport = transport
+	}
+}
+
+// WithLogger sends the library messages to logger.
+func WithLogger(logger Logger) Option {
+	return func(pub *Pubnub) {
+		if logger != nil {
+			pub.logger = logger
+		}
+	}
+}
+
+// WithRequestHook calls hook after each HTTP request attempt, eg. to
+// record tracing spans.
+func WithRequestHook(hook RequestHook) Option {
+	return func(pub *Pubnub) {
+		pub.requestHook = hook
+	}
+}
+
+// UUID returns the client uuid.
+func (pub *Pubnub) UUID() string {
+	return pub.uuid
+}
+
+// originURL adds the scheme to an origin without one and trims the trailing slash.
+func originURL(origin string, sslOn bool) string {
+	origin = strings.TrimRight(origin, "/")
+	if strings.HasPrefix(origin, "http://") || strings.HasPrefix(origin, "https://") {
+		return origin
+	}
+	if sslOn {
+		return "https://" + origin
+	}
+	return "http://" + origin
+}
+
+// generateUUID returns a random (version 4) uuid.
+func generateUUID() string {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return fmt.Sprintf("pn-%d", time.Now().UnixNano())
+	}
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("pn-%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
@@ -0,0 +1,80 @@
+package pubnub
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestProxy(t *testing.T) {
+	auth := "Basic " + base64.StdEncoding.EncodeToString([]byte("user:secret"))
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Proxy-Authorization") != auth {
+			w.WriteHeader(http.StatusProxyAuthRequired)
+			return
+		}
+		fmt.Fprintf(w, "proxied %s", r.URL.Host)
+	}))
+	defer proxy.Close()
+
+	proxyURL, _ := url.Parse(proxy.URL)
+	proxyURL.User = url.UserPassword("user", "secret")
+
+	lib := NewClient("pub", "sub", WithOrigin("http://pubnub.invalid"))
+	if err := lib.SetProxy(&ProxyConfig{URL: proxyURL.String()}); err != nil {
+		t.Fatalf("SetProxy %s", err)
+	}
+
+	buff, code, err := lib.httpRequest(context.Background(), "/time/0", false)
+	if err != nil || code != 200 || string(buff) != "proxied pubnub.invalid" {
+		t.Errorf("Unexpected proxy response %d %q : %v", code, buff, err)
+	}
+
+	if err := lib.SetProxy(&ProxyConfig{URL: "ftp://proxy"}); err == nil {
+		t.Errorf("Expected error for ftp proxy")
+	}
+}
+
+func TestNoProxyEnvironment(t *testing.T) {
+	// no_proxy applies to the proxy of the environment as well
+	proxy, err := (&ProxyConfig{NoProxy: ".internal"}).Func()
+	if err != nil {
+		t.Fatalf("Func %s", err)
+	}
+	req, _ := http.NewRequest(http.MethodGet, "https://pubnub.internal/time/0", nil)
+	if u, err := proxy(req); u != nil || err != nil {
+		t.Errorf("Expected a direct connection got %v %v", u, err)
+	}
+}
+
+func TestBypassProxy(t *testing.T) {
+	noProxy := []string{"localhost", ".internal", "example.com", "10.0.0.1", "origin:8080"}
+	tests := map[string]bool{
+		"http://localhost/":           true,
+		"http://db.internal/":         true,
+		"http://internal/":            true,
+		"http://example.com/":         true,
+		"http://api.example.com/":     true,
+		"http://notexample.com/":      false,
+		"http://10.0.0.1/":            true,
+		"http://origin:8080/":         true,
+		"http://origin:9090/":         false,
+		"https://ps.pndsn.com/time/0": false,
+	}
+
+	for raw, expected := range tests {
+		u, _ := url.Parse(raw)
+		if bypassProxy(u, noProxy) != expected {
+			t.Errorf("Unexpected bypass for %s", raw)
+		}
+	}
+
+	u, _ := url.Parse("https://ps.pndsn.com/")
+	if !bypassProxy(u, []string{"*"}) {
+		t.Errorf("Expected * to bypass all hosts")
+	}
+}
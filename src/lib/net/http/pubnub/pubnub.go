@@ -1,11 +1,10 @@
 package pubnub
 
 import (
-	"crypto/hmac"
-	"crypto/sha256"
-	"crypto/tls"
-	"encoding/base64"
+	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"net"
@@ -19,6 +18,10 @@ import (
 const (
 	origin = "ps.pndsn.com"
 
+	// MaxPublishSize is the largest publish request accepted by PubNub,
+	// measured over the url encoded channel and message.
+	MaxPublishSize = 32 * 1024
+
 	//Sdk Identification Param appended to each request
 	sdkIdentificationParamKey = "pnsdk"
 	sdkIdentificationParamVal = "PubNub-Go/3.16.1"
@@ -37,31 +40,16 @@ var sdkIdentificationParam = fmt.Sprintf("%s=%s", sdkIdentificationParamKey, url
 // cipherKey stores the user specific Cipher Key. Accepts empty string if not used.
 // sslOn is true if enabled, else is false.
 // customUuid is the unique identifier, it can be a custom value or sent as empty for automatic generation.
+// options are applied after the arguments, see NewClient.
 //
 // returns the pointer to Pubnub instance.
-func New(publishKey string, subscribeKey string, secretKey string, cipherKey string, sslOn bool, customUuid string) *Pubnub {
-
-	pubnub := &Pubnub{
-		origin:                "http://" + origin,
-		publishKey:            publishKey,
-		subscribeKey:          subscribeKey,
-		secretKey:             secretKey,
-		cipherKey:             cipherKey,
-		uuid:                  "",
-		subscribedChannels:    "",
-		newSubscribedChannels: "",
-		connectRetry:          3,
-		connectTimeout:        10,
-		nonSubscribeTimeout:   5,
-		presenceChannels:      make(map[string]chan []byte),
-		subscribeChannels:     make(map[string]chan []byte),
-	}
-
-	if sslOn {
-		pubnub.origin = "https://" + origin
-	}
-
-	return pubnub
+func New(publishKey string, subscribeKey string, secretKey string, cipherKey string, sslOn bool, customUuid string, options ...Option) *Pubnub {
+	return NewClient(publishKey, subscribeKey, append([]Option{
+		WithSecretKey(secretKey),
+		WithCipherKey(cipherKey),
+		WithSSL(sslOn),
+		WithUUID(customUuid),
+	}, options...)...)
 }
 
 // GetClient Get a client for transactional requests
@@ -70,18 +58,22 @@ func (pub *Pubnub) GetClient() *http.Client {
 	defer pub.Unlock()
 
 	if pub.client == nil {
-		transport := &http.Transport{
-			// MaxIdleConns: 30,
-			Dial: (&net.Dialer{
-				// Covers establishing a new TCP connection
-				Timeout: time.Duration(pub.connectTimeout) * time.Second,
-			}).Dial,
+		if pub.tlsConfig == nil {
+			pub.tlsConfig, _ = (*TLSConfig)(nil).Build()
+		}
+		if pub.proxy == nil {
+			pub.proxy = http.ProxyFromEnvironment
+		}
+
+		transport := pub.nonSubscribeTransport
+		if transport == nil {
+			transport = newHTTPTransport(&TransportConfig{ConnectTimeout: pub.connectTimeout}, pub.tlsConfig, pub.proxy)
 		}
 
 		client := &http.Client{
 			Transport: transport,
 			// Covers the entire exchange from Dial to reading the body
-			Timeout: time.Duration(pub.nonSubscribeTimeout) * time.Second,
+			Timeout: pub.nonSubscribeTimeout,
 		}
 		pub.client = client
 	}
@@ -89,62 +81,62 @@ func (pub *Pubnub) GetClient() *http.Client {
 	return pub.client
 }
 
+// Publish sends a message, non 200 responses are returned as *APIError.
 func (pub *Pubnub) Publish(channel string, message string, auth string, storeInHistory bool) (*Response, error) {
-	return pub.sendPublish(channel, message, auth, storeInHistory, true, -1)
+	return pub.PublishContext(context.Background(), channel, message, auth, storeInHistory)
+}
+
+// PublishContext is Publish aborted when ctx is done.
+func (pub *Pubnub) PublishContext(ctx context.Context, channel string, message string, auth string, storeInHistory bool) (*Response, error) {
+	return pub.sendPublish(ctx, channel, message, "", auth, storeInHistory, true, -1)
 }
 
-func (pub *Pubnub) sendPublish(channel string, message string, auth string, storeInHistory, replicate bool, ttl int) (*Response, error) {
+// PublishMetaContext is PublishContext with meta, a json object delivered
+// alongside the message and usable by subscribe filters.
+func (pub *Pubnub) PublishMetaContext(ctx context.Context, channel string, message string, meta string, auth string, storeInHistory bool) (*Response, error) {
+	return pub.sendPublish(ctx, channel, message, meta, auth, storeInHistory, true, -1)
+}
 
-	signature := "0"
-	if pub.secretKey != "" {
-		signature = getHmacSha256(pub.secretKey, fmt.Sprintf("%s/%s/%s/%s/%s", pub.publishKey, pub.subscribeKey, pub.secretKey, channel, message))
-	}
+func (pub *Pubnub) sendPublish(ctx context.Context, channel string, message string, meta string, auth string, storeInHistory, replicate bool, ttl int) (*Response, error) {
 
-	publishURL := fmt.Sprintf("/publish/%s/%s/%s/%s/0/%s",
-		pub.publishKey, pub.subscribeKey, signature,
-		url.QueryEscape(channel),
+	// The legacy message signature is replaced by the request signature
+	path := fmt.Sprintf("/publish/%s/%s/0/%s/0/%s",
+		pub.publishKey, pub.subscribeKey,
+		Escape(channel),
 		encodeJSONAsPathComponent(message))
-	requestURL := publishURL
 
-	// Sdk
-	publishURL += "?" + sdkIdentificationParam
+	query := url.Values{}
 
-	// Send auth-key
+	// Send auth-key, or a PAM v3 token
 	if auth != "" {
-		publishURL = fmt.Sprintf("%s&auth=%s", publishURL, auth)
+		query.Set("auth", auth)
 	}
 
 	// Skip history
 	if storeInHistory == false {
-		publishURL = fmt.Sprintf("%s&store=0", publishURL)
+		query.Set("store", "0")
+	}
+
+	if meta != "" {
+		query.Set("meta", meta)
 	}
 
 	if !replicate {
-		publishURL = fmt.Sprintf("%s&norep=true", publishURL)
+		query.Set("norep", "true")
 	}
 
 	if ttl >= 0 {
-		publishURL = fmt.Sprintf("%s&ttl=%d", publishURL, ttl)
+		query.Set("ttl", strconv.Itoa(ttl))
 	}
 
-	publishURL = pub.checkSecretKeyAndAddSignature(publishURL, requestURL)
-
-	value, responseCode, err := pub.httpRequest(publishURL, false)
+	value, responseCode, err := pub.httpRequest(ctx, pub.signedURL(ctx, "GET", path, query, nil), false)
 	if err != nil {
-		return nil, fmt.Errorf("Publish Error Internal: %s", err)
+		return nil, fmt.Errorf("Publish Error Internal: %w", err)
 	}
 
 	// Response code
 	if responseCode != 200 {
-		var response *Response
-		if e := json.Unmarshal([]byte(value), &response); e != nil {
-			return &Response{
-				Status:  400,
-				Error:   false,
-				Message: e.Error(),
-			}, nil
-		}
-		return response, nil
+		return nil, newAPIError(responseCode, value)
 	}
 
 	return &Response{
@@ -156,16 +148,26 @@ func (pub *Pubnub) sendPublish(channel string, message string, auth string, stor
 
 // Grant auth access rights
 func (pub *Pubnub) Grant(channel string, auth string, read_perm bool, write_perm bool, ttl int) (*GrantResponse, error) {
-	return pub._auth(channel, auth, read_perm, write_perm, ttl)
+	return pub.GrantContext(context.Background(), channel, auth, read_perm, write_perm, ttl)
+}
+
+// GrantContext is Grant aborted when ctx is done.
+func (pub *Pubnub) GrantContext(ctx context.Context, channel string, auth string, read_perm bool, write_perm bool, ttl int) (*GrantResponse, error) {
+	return pub._auth(ctx, channel, auth, read_perm, write_perm, ttl)
 }
 
 // Revoke auth access rights
 func (pub *Pubnub) Revoke(channel string, auth string, ttl int) (*GrantResponse, error) {
-	return pub._auth(channel, auth, false, false, ttl)
+	return pub.RevokeContext(context.Background(), channel, auth, ttl)
+}
+
+// RevokeContext is Revoke aborted when ctx is done.
+func (pub *Pubnub) RevokeContext(ctx context.Context, channel string, auth string, ttl int) (*GrantResponse, error) {
+	return pub._auth(ctx, channel, auth, false, false, ttl)
 }
 
 // Pubnub's auth call
-func (pub *Pubnub) _auth(channel string, auth string, read_perm bool, write_perm bool, ttl int) (*GrantResponse, error) {
+func (pub *Pubnub) _auth(ctx context.Context, channel string, auth string, read_perm bool, write_perm bool, ttl int) (*GrantResponse, error) {
 
 	read_str := "0"
 	if read_perm {
@@ -175,35 +177,25 @@ func (pub *Pubnub) _auth(channel string, auth string, read_perm bool, write_perm
 	if write_perm {
 		write_str = "1"
 	}
-	params := ""
+
+	query := url.Values{}
 	if auth != "" {
-		params = "auth=" + auth
-		params += "&channel=" + channel
-	} else {
-		params += "channel=" + channel
+		query.Set("auth", auth)
 	}
-	params += "&r=" + read_str
-	params += "&timestamp=" + fmt.Sprintf("%d", time.Now().Unix())
-
+	query.Set("channel", channel)
+	query.Set("r", read_str)
+	query.Set("w", write_str)
 	if ttl > -1 {
-		params += "&ttl=" + strconv.Itoa(ttl)
+		query.Set("ttl", strconv.Itoa(ttl))
 	}
-	params += "&w=" + write_str
-
-	// Sign request
-	signature := getHmacSha256(
-		pub.secretKey,
-		pub.subscribeKey+"\n"+pub.publishKey+"\ngrant\n"+params,
-	)
 
-	params += "&signature=" + signature
-
-	value, responseCode, err := pub.httpRequest("/v1/auth/grant/sub-key/"+pub.subscribeKey+"?"+params, false)
+	path := "/v2/auth/grant/sub-key/" + pub.subscribeKey
+	value, responseCode, err := pub.httpRequest(ctx, pub.signedURL(ctx, "GET", path, query, nil), false)
 	if (responseCode != 200) || (err != nil) {
 		if err != nil {
-			return nil, fmt.Errorf("PAM Error Internal: %s", err)
+			return nil, fmt.Errorf("PAM Error Internal: %w", err)
 		}
-		return nil, fmt.Errorf("PAM Error Message: %s", value)
+		return nil, newAPIError(responseCode, value)
 	}
 
 	var response *GrantResponse
@@ -216,19 +208,37 @@ func (pub *Pubnub) _auth(channel string, auth string, read_perm bool, write_perm
 }
 
 // -------------------- Private functions -----------------------------------
-func (pub *Pubnub) httpRequest(requestURL string, isSubscribe bool) ([]byte, int, error) {
+func (pub *Pubnub) httpRequest(ctx context.Context, requestURL string, isSubscribe bool) ([]byte, int, error) {
+	return pub.httpRequestMethod(ctx, "GET", requestURL, nil)
+}
+
+// httpRequestMethod sends a request with an optional json body.
+func (pub *Pubnub) httpRequestMethod(ctx context.Context, method string, requestURL string, body []byte) ([]byte, int, error) {
 
 	retryCount := 0
 retryRequest:
-	req, err := http.NewRequest("GET", pub.origin+requestURL, nil)
+	req, err := http.NewRequestWithContext(ctx, method, pub.origin+requestURL, bytes.NewReader(body))
+	if err != nil {
+		return nil, 0, redactURL(err)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
 	// User Agent
 	req.Header.Set("User-Agent", fmt.Sprintf("ua_string=(%s) %s",
 		sdkIdentificationParamKey,
 		sdkIdentificationParamVal,
 	))
 
+	start := time.Now()
 	response, err := pub.GetClient().Do(req)
 	if err != nil {
+		err = redactURL(err)
+		pub.observe(ctx, req, start, 0, retryCount, err)
+		// Cancelled or past the caller deadline
+		if ctx.Err() != nil {
+			return nil, 0, ctx.Err()
+		}
 		// Check for net.Timeout errors
 		if e, ok := err.(*url.Error); ok {
 			if nerr, ok := e.Err.(net.Error); ok && nerr.Timeout() && retryCount < pub.connectRetry {
@@ -242,6 +252,7 @@ retryRequest:
 
 	// readBody
 	bodyContents, err := ioutil.ReadAll(response.Body)
+	pub.observe(ctx, req, start, response.StatusCode, retryCount, err)
 	if err != nil {
 		return nil, response.StatusCode, err
 	}
@@ -250,56 +261,66 @@ retryRequest:
 
 }
 
-func (pub *Pubnub) setOrGetTransport(isSubscribe bool) http.RoundTripper {
-	transport := &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
-		Dial: func(netw, addr string) (net.Conn, error) {
-			c, err := net.DialTimeout(netw, addr, time.Duration(pub.connectTimeout)*time.Second)
-
-			if c != nil {
-				if isSubscribe {
-					deadline := time.Now().Add(time.Duration(pub.subscribeTimeout) * time.Second)
-					c.SetDeadline(deadline)
-					pub.subscribeConn = c
-				} else {
-					deadline := time.Now().Add(time.Duration(pub.nonSubscribeTimeout) * time.Second)
-					c.SetDeadline(deadline)
-					pub.nonSubscribeConn = c
-				}
-			} else {
-				err = fmt.Errorf("Error in initializing connection: %s", err.Error())
-			}
-
-			if err != nil {
-				return nil, err
-			}
-
-			return c, nil
-		}}
-
-	return transport
+// redactURL keeps the origin and endpoint of the url of a transport
+// error, its path and query carry keys, channels, messages and signatures.
+func redactURL(err error) error {
+	var urlErr *url.Error
+	if !errors.As(err, &urlErr) {
+		return err
+	}
+	u, perr := url.Parse(urlErr.URL)
+	if perr != nil {
+		urlErr.URL = ""
+		return err
+	}
+	urlErr.URL = u.Scheme + "://" + u.Host + "/" + endpointOf(u.Path)
+	return err
 }
 
-func (pub *Pubnub) checkSecretKeyAndAddSignature(opURL, requestURL string) string {
-	if len(pub.secretKey) > 0 {
-		opURL = fmt.Sprintf("%s&timestamp=%d", opURL, time.Now().Unix())
+// observe reports a request attempt to the request hook.
+func (pub *Pubnub) observe(ctx context.Context, req *http.Request, start time.Time, status int, retry int, err error) {
+	if pub.requestHook == nil {
+		return
+	}
+	pub.requestHook(ctx, &RequestEvent{
+		Method:   req.Method,
+		Endpoint: endpointOf(req.URL.Path),
+		Status:   status,
+		Retry:    retry,
+		Start:    start,
+		End:      time.Now(),
+		Err:      err,
+	})
+}
 
-		var reqURL *url.URL
-		reqURL, urlErr := url.Parse(opURL)
-		if urlErr != nil {
-			return opURL
+// endpointOf keeps the leading path segments before the first key or
+// argument, so events never carry keys, channels or messages.
+func endpointOf(path string) string {
+	var segments []string
+	for _, segment := range strings.Split(strings.Trim(path, "/"), "/") {
+		if segment == "0" || strings.HasPrefix(segment, "pub-") || strings.HasPrefix(segment, "sub-") {
+			break
 		}
-		rawQuery := reqURL.RawQuery
-
-		//sort query
-		query, _ := url.ParseQuery(rawQuery)
-		signature := getHmacSha256(
-			pub.secretKey,
-			pub.subscribeKey+"\n"+pub.publishKey+"\n"+requestURL+"\n"+query.Encode(),
-		)
-		opURL = fmt.Sprintf("%s&signature=%s", opURL, signature)
-		return opURL
+		segments = append(segments, segment)
 	}
-	return opURL
+	return strings.Join(segments, "/")
+}
+
+// Timetoken returns the timetoken of a publish response, "" when the
+// response is not a publish result.
+func (r *Response) Timetoken() string {
+	var result []interface{}
+	if json.Unmarshal([]byte(r.Message), &result) != nil || len(result) < 3 {
+		return ""
+	}
+	timetoken, _ := result[2].(string)
+	return timetoken
+}
+
+// PublishSize returns the size of the channel and message as they are encoded
+// in the publish request, to be compared against MaxPublishSize.
+func PublishSize(channel string, message string) int {
+	return len(Escape(channel)) + len(encodeJSONAsPathComponent(message))
 }
 
 // encodeJSONAsPathComponent properly encodes serialized JSON
@@ -308,10 +329,3 @@ func encodeJSONAsPathComponent(jsonBytes string) string {
 	u := &url.URL{Path: jsonBytes}
 	return strings.TrimLeft(u.String(), "./")
 }
-
-func getHmacSha256(secretKey string, input string) string {
-	hmacSha256 := hmac.New(sha256.New, []byte(secretKey))
-	hmacSha256.Write([]byte(input))
-	rawSig := base64.StdEncoding.EncodeToString(hmacSha256.Sum(nil))
-	return strings.Replace(strings.Replace(rawSig, "+", "-", -1), "/", "_", -1)
-}
@@ -1,45 +1,372 @@
 package pubnub
 
 import (
-	"fmt"
-	"net"
+	"context"
+	"errors"
 	"net/http"
+	"net/url"
+	"strings"
+	"sync"
 	"testing"
 	"time"
+
+	"lib/net/http/pubnub/pubnubtest"
 )
 
-func zTestSendRequest(t *testing.T) {
-	l, err := net.Listen("tcp4", "127.0.0.1:0")
-	if err != nil {
-		t.Fatal(err)
+const (
+	testPublishKey   = "pub-c-00000000-0000-0000-0000-000000000000"
+	testSubscribeKey = "sub-c-00000000-0000-0000-0000-000000000000"
+	testSecretKey    = "sec-c-MDAwMDAwMDAtMDAwMC0wMDAwLTAwMDAtMDAwMDAwMDAwMDAw"
+)
 
+// newTestPubnub starts a fake origin and returns a client using it.
+func newTestPubnub(t *testing.T) (*Pubnub, *pubnubtest.Server) {
+	srv := pubnubtest.NewServer(testPublishKey, testSubscribeKey, testSecretKey)
+	t.Cleanup(srv.Close)
+	return New(testPublishKey, testSubscribeKey, testSecretKey, "", false, "", WithOrigin(srv.URL)), srv
+}
+
+func TestGrant(t *testing.T) {
+	pubnub, srv := newTestPubnub(t)
+
+	request := func(wg *sync.WaitGroup, t *testing.T) {
+		defer wg.Done()
+		response, err := pubnub.Grant("console", "auth_AAA", true, true, 1700)
+		if err != nil {
+			t.Errorf("Grant %s", err)
+			return
+		}
+		if response.Status != 200 || response.Payload.Auths["auth_AAA"].W != 1 {
+			t.Errorf("Unexpected response %+v", response)
+		}
 	}
-	t.Logf("%s", l.Addr().String())
 
-	lib := Pubnub{
-		origin:              fmt.Sprintf("http://%s/", l.Addr().String()),
-		connectRetry:        3,
-		connectTimeout:      10,
-		subscribeTimeout:    310,
-		nonSubscribeTimeout: 5,
+	wg := &sync.WaitGroup{}
+	for i := 1; i < 10; i++ {
+		wg.Add(1)
+		go request(wg, t)
 	}
+	wg.Wait()
 
-	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		fmt.Fprintf(w, "\n")
-		time.Sleep(time.Duration(lib.nonSubscribeTimeout) * time.Second)
-		fmt.Fprintf(w, "Hi there, I love %s!", r.URL.Path[1:])
+	if g := srv.Grants("console")["auth_AAA"]; g.R != 1 || g.W != 1 || g.TTL != 1700 {
+		t.Errorf("Unexpected grant %+v", g)
+	}
 
-	})
+	if _, err := pubnub.Revoke("console", "auth_AAA", 0); err != nil {
+		t.Errorf("Revoke %s", err)
+	}
+	if _, found := srv.Grants("console")["auth_AAA"]; found {
+		t.Errorf("Expected grant to be revoked")
+	}
+}
 
-	go http.Serve(l, nil)
+func TestGrantInvalidSignature(t *testing.T) {
+	pubnub, _ := newTestPubnub(t)
+	pubnub.secretKey = "sec-c-wrong"
+
+	if _, err := pubnub.Grant("console", "auth_AAA", true, true, 1700); err == nil {
+		t.Errorf("Expected grant with a wrong secret key to fail")
+	}
+}
 
-	buff, code, err := lib.httpRequest("user", false)
+func TestPublish(t *testing.T) {
+	pubnub, srv := newTestPubnub(t)
+
+	messages := []string{`{"id":1}`, `[1,"a/b?c#d e"]`, `42`}
+	for _, message := range messages {
+		response, err := pubnub.Publish("orders", message, "", true)
+		if err != nil || response.Status != 200 {
+			t.Fatalf("Publish %s : %+v %v", message, response, err)
+		}
+		if response.Timetoken() == "" {
+			t.Errorf("Expected a timetoken in %s", response.Message)
+		}
+	}
+
+	history := srv.History("orders")
+	if len(history) != len(messages) {
+		t.Fatalf("Expected %d messages got %d", len(messages), len(history))
+	}
+	for i, message := range messages {
+		if string(history[i].Message) != message {
+			t.Errorf("Expected %s got %s", message, history[i].Message)
+		}
+	}
+
+	if _, err := pubnub.Publish("orders", `{"id":4}`, "", false); err != nil {
+		t.Errorf("Publish %s", err)
+	}
+	if len(srv.History("orders")) != len(messages) {
+		t.Errorf("Expected message without history not to be stored")
+	}
+}
+
+func TestPublishMeta(t *testing.T) {
+	pubnub, srv := newTestPubnub(t)
+
+	// meta is part of the signed query
+	meta := `{"message_id":"01HX5Z0000000000000000000A"}`
+	if _, err := pubnub.PublishMetaContext(context.Background(), "orders", `{"id":1}`, meta, "", true); err != nil {
+		t.Fatalf("Publish %s", err)
+	}
+	if history := srv.History("orders"); len(history) != 1 || string(history[0].Meta) != meta {
+		t.Errorf("Expected meta %s got %+v", meta, history)
+	}
+
+	if _, err := pubnub.PublishMetaContext(context.Background(), "orders", `{"id":2}`, `[1]`, "", true); err == nil {
+		t.Errorf("Expected meta which is not an object to be rejected")
+	}
+}
+
+func TestRequestHook(t *testing.T) {
+	srv := pubnubtest.NewServer(testPublishKey, testSubscribeKey, testSecretKey)
+	t.Cleanup(srv.Close)
+
+	type key struct{}
+	var events []*RequestEvent
+	pubnub := New(testPublishKey, testSubscribeKey, testSecretKey, "", false, "", WithOrigin(srv.URL),
+		WithRequestHook(func(ctx context.Context, e *RequestEvent) {
+			if ctx.Value(key{}) != "call" {
+				t.Errorf("Expected the context of the call")
+			}
+			events = append(events, e)
+		}))
+
+	ctx := context.WithValue(context.Background(), key{}, "call")
+	srv.Inject(pubnubtest.ServerError, 1)
+	pubnub.PublishContext(ctx, "orders", `{"id":1}`, "", true)
+	pubnub.GrantContext(ctx, "orders", "reader", true, false, 5)
+
+	expected := []RequestEvent{
+		{Method: "GET", Endpoint: "publish", Status: 500},
+		{Method: "GET", Endpoint: "v2/auth/grant", Status: 200},
+	}
+	if len(events) != len(expected) {
+		t.Fatalf("Expected %d events got %d", len(expected), len(events))
+	}
+	for i, e := range events {
+		if e.Method != expected[i].Method || e.Endpoint != expected[i].Endpoint || e.Status != expected[i].Status {
+			t.Errorf("Expected %+v got %+v", expected[i], e)
+		}
+		if e.Err != nil || e.End.Before(e.Start) {
+			t.Errorf("Unexpected event %+v", e)
+		}
+	}
+}
+
+func TestPublishFaults(t *testing.T) {
+	pubnub, srv := newTestPubnub(t)
+
+	tests := []struct {
+		fault     pubnubtest.Fault
+		status    int
+		class     error
+		retryable bool
+	}{
+		{pubnubtest.Forbidden, 403, ErrAuth, false},
+		{pubnubtest.ServerError, 500, nil, true},
+		{pubnubtest.Fault{Status: 429, Body: "Too Many Requests"}, 429, ErrQuota, true},
+		{pubnubtest.Fault{Status: 414, Body: `{"status":414,"message":"Request URI Too Long"}`}, 414, ErrValidation, false},
+	}
+
+	for _, test := range tests {
+		srv.Inject(test.fault, 1)
+		_, err := pubnub.Publish("orders", `{"id":1}`, "", true)
+
+		var apiErr *APIError
+		if !errors.As(err, &apiErr) || apiErr.Status != test.status {
+			t.Errorf("Expected %d got %v", test.status, err)
+			continue
+		}
+		if test.class != nil && !errors.Is(err, test.class) {
+			t.Errorf("Expected %d to be %s", test.status, test.class)
+		}
+		if Retryable(err) != test.retryable {
+			t.Errorf("Unexpected retryable for %d", test.status)
+		}
+	}
+
+	if n := srv.Count(pubnubtest.EndpointPublish, 0); n != len(tests) {
+		t.Errorf("Expected %d recorded publish got %d", len(tests), n)
+	}
+
+	_, err := pubnub.Grant("console", "auth", true, true, 60)
 	if err != nil {
-		t.Fatalf("httpRequest %s", err)
-		return
+		t.Errorf("Grant %s", err)
+	}
+	pubnub.secretKey = "sec-c-wrong"
+	if _, err := pubnub.Grant("console", "auth", true, true, 60); !errors.Is(err, ErrAuth) {
+		t.Errorf("Expected %s got %v", ErrAuth, err)
+	}
+}
+
+func TestRetryable(t *testing.T) {
+	pubnub := NewClient("pub", "sub", WithOrigin("http://127.0.0.1:1"), WithRetry(0))
+	_, err := pubnub.Publish("orders", `{"id":1}`, "", true)
+	if err == nil || !Retryable(err) {
+		t.Errorf("Expected connection error to be retryable got %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := pubnub.PublishContext(ctx, "orders", `{"id":1}`, "", true); Retryable(err) || !Aborted(err) {
+		t.Errorf("Expected cancelled request aborted got %v", err)
+	}
+
+	// Invalid settings
+	badProxy := &http.Transport{Proxy: func(*http.Request) (*url.URL, error) {
+		return nil, errors.New("invalid proxy")
+	}}
+	pubnub = NewClient("pub", "sub", WithOrigin("http://127.0.0.1:1"), WithRetry(0), WithTransport(badProxy))
+	if _, err := pubnub.Publish("orders", `{"id":1}`, "", true); err == nil || Retryable(err) {
+		t.Errorf("Expected proxy error not to be retryable got %v", err)
+	}
+}
+
+func TestTransportErrorRedacted(t *testing.T) {
+	pubnub := NewClient("pub-c-x", "sub-c-x", WithOrigin("http://127.0.0.1:1"), WithRetry(0), WithSecretKey("sec-c-x"))
+	_, err := pubnub.Publish("orders", `{"ssn":"123-45-6789"}`, "auth-key", true)
+	if err == nil {
+		t.Fatalf("Expected connection error")
+	}
+	for _, secret := range []string{"ssn", "123-45-6789", "orders", "pub-c-x", "auth-key", "signature"} {
+		if strings.Contains(err.Error(), secret) {
+			t.Errorf("Expected %q redacted got %s", secret, err)
+		}
+	}
+	if !strings.Contains(err.Error(), "http://127.0.0.1:1/publish") {
+		t.Errorf("Expected the endpoint in %s", err)
+	}
+}
+
+func TestSendRequestTimeout(t *testing.T) {
+	srv := pubnubtest.NewServer(testPublishKey, testSubscribeKey, testSecretKey)
+	defer srv.Close()
+	srv.SetLatency(time.Second)
+
+	pubnub := NewClient(testPublishKey, testSubscribeKey,
+		WithOrigin(srv.URL),
+		WithRetry(2),
+		WithNonSubscribeTimeout(100*time.Millisecond),
+	)
+	if _, _, err := pubnub.httpRequest(context.Background(), "/time/0", false); err == nil || Aborted(err) || !Retryable(err) {
+		t.Errorf("Expected retryable timeout got %v", err)
+	}
+
+	// Past the caller deadline, the error is wrapped by the public methods
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := pubnub.GrantContext(ctx, "orders", "auth", true, false, 5); !Aborted(err) || Retryable(err) {
+		t.Errorf("Expected aborted grant got %v", err)
+	}
+	// Aborted requests are recorded once the server notices
+	deadline := time.Now().Add(time.Second)
+	for srv.Count(pubnubtest.EndpointTime, 0) < 3 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := srv.Count(pubnubtest.EndpointTime, 0); n != 3 {
+		t.Errorf("Expected 3 attempts got %d", n)
+	}
+}
+
+func TestOrigin(t *testing.T) {
+	tests := []struct {
+		origin   string
+		ssl      bool
+		expected string
+	}{
+		{"", true, "https://ps.pndsn.com"},
+		{"", false, "http://ps.pndsn.com"},
+		{"custom.pubnubapi.com", true, "https://custom.pubnubapi.com"},
+		{"localhost:8080", false, "http://localhost:8080"},
+		{"http://localhost:8080/pubnub/", true, "http://localhost:8080/pubnub"},
+	}
+
+	for _, test := range tests {
+		lib := New("pub", "sub", "", "", test.ssl, "", WithOrigin(test.origin))
+		if lib.origin != test.expected {
+			t.Errorf("Expected %s for %q got %s", test.expected, test.origin, lib.origin)
+		}
+	}
+}
+
+func TestPublishContext(t *testing.T) {
+	pubnub, srv := newTestPubnub(t)
+	srv.SetLatency(time.Second)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	_, err := pubnub.PublishContext(ctx, "orders", `{"id":1}`, "", true)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected %s got %v", context.DeadlineExceeded, err)
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("Publish returned after %s", elapsed)
+	}
+
+	ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+	if _, err := pubnub.GrantContext(ctx, "orders", "auth", true, false, 60); !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected %s got %v", context.Canceled, err)
+	}
+}
+
+func TestNewClient(t *testing.T) {
+	lib := New("pub", "sub", "sec", "", true, "custom-uuid")
+	if lib.UUID() != "custom-uuid" || lib.secretKey != "sec" || lib.origin != "https://ps.pndsn.com" {
+		t.Errorf("Unexpected client %+v", lib)
+	}
+
+	lib = NewClient("pub", "sub")
+	if !strings.HasPrefix(lib.UUID(), "pn-") || lib.UUID() == NewClient("pub", "sub").UUID() {
+		t.Errorf("Expected a generated uuid got %q", lib.UUID())
+	}
+
+	client := &http.Client{}
+	lib = NewClient("pub", "sub",
+		WithConnectTimeout(time.Second),
+		WithNonSubscribeTimeout(2*time.Second),
+		WithRetry(1),
+		WithHTTPClient(client),
+	)
+	if lib.connectTimeout != time.Second || lib.nonSubscribeTimeout != 2*time.Second || lib.connectRetry != 1 {
+		t.Errorf("Unexpected settings %+v", lib)
+	}
+	lib.SetTLS(&TLSConfig{Insecure: true})
+	if lib.GetClient() != client {
+		t.Errorf("Expected the custom client")
+	}
+}
+
+type recordTransport struct {
+	requests int
+}
+
+func (rt *recordTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	rt.requests++
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+func TestWithTransport(t *testing.T) {
+	srv := pubnubtest.NewServer(testPublishKey, testSubscribeKey, testSecretKey)
+	defer srv.Close()
+
+	rt := &recordTransport{}
+	lib := NewClient(testPublishKey, testSubscribeKey,
+		WithSecretKey(testSecretKey),
+		WithOrigin(srv.URL),
+		WithTransport(rt),
+		WithUUID("uuid-1"),
+	)
+	if _, err := lib.Publish("orders", `{"id":1}`, "", true); err != nil {
+		t.Fatalf("Publish %s", err)
+	}
+	if rt.requests != 1 {
+		t.Errorf("Expected 1 request through the transport got %d", rt.requests)
 	}
-	if code != 200 {
-		t.Logf("Return code %d", code)
+	if uuid := srv.Requests()[0].Query.Get("uuid"); uuid != "uuid-1" {
+		t.Errorf("Expected uuid-1 got %q", uuid)
 	}
-	t.Logf("%s ", buff)
 }
@@ -0,0 +1,548 @@
+// Package pubnubtest provides a fake PubNub origin for hermetic tests.
+//
+// The server implements the publish, grant (and revoke), audit, history,
+// time and PAM v3 grant and revoke token endpoints, verifies the v2 request signatures when a secret key is set,
+// records every request and can inject latency and failures.
+package pubnubtest
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Endpoints
+const (
+	EndpointPublish = "publish"
+	EndpointGrant   = "grant" // Revoke is a grant without rights
+	EndpointAudit   = "audit"
+	EndpointHistory = "history"
+	EndpointTime    = "time"
+)
+
+type (
+	// Server is a fake PubNub origin, use Server.URL as the client origin.
+	Server struct {
+		*httptest.Server
+
+		PublishKey   string
+		SubscribeKey string
+		SecretKey    string // Signatures are verified when set
+
+		mu        sync.Mutex
+		requests  []Request
+		faults    []*fault
+		latency   time.Duration
+		offset    time.Duration
+		timetoken int64
+		history   map[string][]Message
+		grants    map[string]map[string]Grant
+		tokens    map[string]bool // Granted tokens, true when revoked
+	}
+
+	// Request is a request received by the server.
+	Request struct {
+		Endpoint string
+		Channel  string
+		Query    url.Values
+		Message  string // Publish only
+		Status   int    // Status code returned
+		Time     time.Time
+	}
+
+	// Message is a published message kept in history.
+	Message struct {
+		Message   json.RawMessage
+		Meta      json.RawMessage // Publish meta, nil when not sent
+		Timetoken int64
+	}
+
+	// Grant are the rights of an auth key on a channel.
+	Grant struct {
+		R   int `json:"r"`
+		W   int `json:"w"`
+		M   int `json:"m"`
+		TTL int `json:"ttl"`
+	}
+
+	// Fault replaces the response of requests to Endpoint (any when empty).
+	Fault struct {
+		Endpoint string
+		Delay    time.Duration // Wait before responding
+		Status   int           // Status code, 200 when only Body is set
+		Body     string        // Response body, eg. a malformed json
+	}
+
+	fault struct {
+		Fault
+		count int
+	}
+)
+
+// MaxSkew is the accepted difference between signed request timestamps and the server clock.
+const MaxSkew = time.Minute
+
+// Common faults
+var (
+	Forbidden   = Fault{Status: http.StatusForbidden, Body: `{"status":403,"service":"Access Manager","error":true,"message":"Forbidden"}`}
+	ServerError = Fault{Status: http.StatusInternalServerError, Body: `{"status":500,"error":true,"message":"Internal Server Error"}`}
+	Malformed   = Fault{Status: http.StatusOK, Body: `{"status":200,`}
+)
+
+// NewServer starts a fake origin accepting the given keys.
+func NewServer(publishKey, subscribeKey, secretKey string) *Server {
+	s := &Server{
+		PublishKey:   publishKey,
+		SubscribeKey: subscribeKey,
+		SecretKey:    secretKey,
+		history:      make(map[string][]Message),
+		grants:       make(map[string]map[string]Grant),
+		tokens:       make(map[string]bool),
+	}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serveHTTP))
+	return s
+}
+
+// Requests returns the recorded requests.
+func (s *Server) Requests() []Request {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Request(nil), s.requests...)
+}
+
+// Count returns the number of requests to endpoint answered with status (any when 0).
+func (s *Server) Count(endpoint string, status int) int {
+	n := 0
+	for _, r := range s.Requests() {
+		if r.Endpoint == endpoint && (status == 0 || r.Status == status) {
+			n++
+		}
+	}
+	return n
+}
+
+// History returns the messages stored for channel.
+func (s *Server) History(channel string) []Message {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Message(nil), s.history[channel]...)
+}
+
+// Grants returns the rights of the auth keys on channel.
+func (s *Server) Grants(channel string) map[string]Grant {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	grants := make(map[string]Grant)
+	for auth, g := range s.grants[channel] {
+		grants[auth] = g
+	}
+	return grants
+}
+
+// SetLatency delays every response.
+func (s *Server) SetLatency(latency time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.latency = latency
+}
+
+// SetClockOffset shifts the server clock, signed requests with a timestamp
+// more than MaxSkew away from it are rejected.
+func (s *Server) SetClockOffset(offset time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.offset = offset
+}
+
+// Inject queues a fault for the next count matching requests, faults are applied in order.
+func (s *Server) Inject(f Fault, count int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.faults = append(s.faults, &fault{Fault: f, count: count})
+}
+
+// Reset drops recorded requests, faults, history and grants.
+func (s *Server) Reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.requests = nil
+	s.faults = nil
+	s.latency = 0
+	s.offset = 0
+	s.history = make(map[string][]Message)
+	s.grants = make(map[string]map[string]Grant)
+	s.tokens = make(map[string]bool)
+}
+
+func (s *Server) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	req := Request{Query: r.URL.Query(), Time: time.Now()}
+	path := strings.Split(strings.TrimPrefix(r.URL.EscapedPath(), "/"), "/")
+
+	var handler func(*Request, []string, *http.Request) (int, interface{})
+	switch {
+	// Messages are not escaped for "/"
+	case len(path) >= 7 && path[0] == "publish":
+		req.Endpoint, handler = EndpointPublish, s.handlePublish
+	case len(path) == 5 && path[0] == "v2" && path[1] == "auth" && path[2] == "grant":
+		req.Endpoint, handler = EndpointGrant, s.handleGrant
+	case len(path) == 5 && path[0] == "v2" && path[1] == "auth" && path[2] == "audit":
+		req.Endpoint, handler = EndpointAudit, s.handleAudit
+	case len(path) == 6 && path[0] == "v2" && path[1] == "history":
+		req.Endpoint, handler = EndpointHistory, s.handleHistory
+	case len(path) == 4 && path[0] == "v3" && path[1] == "pam" && path[3] == "grant" && r.Method == "POST":
+		req.Endpoint, handler = EndpointGrantToken, s.handleGrantToken
+	case len(path) == 5 && path[0] == "v3" && path[1] == "pam" && path[3] == "grant" && r.Method == "DELETE":
+		req.Endpoint, handler = EndpointRevokeToken, s.handleRevokeToken
+	case len(path) == 2 && path[0] == "time":
+		req.Endpoint, handler = EndpointTime, s.handleTime
+	default:
+		s.respond(w, &req, http.StatusNotFound, map[string]interface{}{"status": 404, "error": true, "message": "Not Found"})
+		return
+	}
+
+	s.mu.Lock()
+	latency := s.latency
+	f := s.nextFault(req.Endpoint)
+	s.mu.Unlock()
+
+	sleep(r, latency)
+
+	if f != nil {
+		sleep(r, f.Delay)
+		status := f.Status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		req.Status = status
+		s.record(req)
+		w.WriteHeader(status)
+		fmt.Fprint(w, f.Body)
+		return
+	}
+
+	status, body := handler(&req, path, r)
+	s.respond(w, &req, status, body)
+}
+
+func (s *Server) respond(w http.ResponseWriter, req *Request, status int, body interface{}) {
+	req.Status = status
+	s.record(*req)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
+
+func (s *Server) record(req Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.requests = append(s.requests, req)
+}
+
+// nextFault returns the next fault for endpoint, must be called with mu held.
+func (s *Server) nextFault(endpoint string) *Fault {
+	for i, f := range s.faults {
+		if f.Endpoint != "" && f.Endpoint != endpoint {
+			continue
+		}
+		f.count--
+		if f.count <= 0 {
+			s.faults = append(s.faults[:i], s.faults[i+1:]...)
+		}
+		return &f.Fault
+	}
+	return nil
+}
+
+func (s *Server) nextTimetoken() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t := time.Now().Add(s.offset).UnixNano() / 100
+	if t <= s.timetoken {
+		t = s.timetoken + 1
+	}
+	s.timetoken = t
+	return t
+}
+
+// /publish/{pub}/{sub}/0/{channel}/0/{message}
+func (s *Server) handlePublish(req *Request, path []string, r *http.Request) (int, interface{}) {
+	channel, _ := url.QueryUnescape(path[4])
+	message, _ := url.PathUnescape(strings.Join(path[6:], "/"))
+	req.Channel, req.Message = channel, message
+
+	if path[1] != s.PublishKey || path[2] != s.SubscribeKey {
+		return http.StatusBadRequest, errorBody(400, "Invalid Key")
+	}
+
+	if s.SecretKey != "" {
+		if status, body := s.verify(r, nil); status != http.StatusOK {
+			return status, body
+		}
+	}
+
+	if s.revoked(req.Query.Get("auth")) {
+		return http.StatusForbidden, errorBody(403, "Token is revoked")
+	}
+
+	if !json.Valid([]byte(message)) {
+		return http.StatusBadRequest, errorBody(400, "Invalid JSON")
+	}
+
+	var meta json.RawMessage
+	if m := req.Query.Get("meta"); m != "" {
+		var object map[string]interface{}
+		if json.Unmarshal([]byte(m), &object) != nil {
+			return http.StatusBadRequest, errorBody(400, "Invalid meta")
+		}
+		meta = json.RawMessage(m)
+	}
+
+	timetoken := s.nextTimetoken()
+	if req.Query.Get("store") != "0" {
+		s.mu.Lock()
+		s.history[channel] = append(s.history[channel], Message{Message: json.RawMessage(message), Meta: meta, Timetoken: timetoken})
+		s.mu.Unlock()
+	}
+
+	return http.StatusOK, []interface{}{1, "Sent", strconv.FormatInt(timetoken, 10)}
+}
+
+// /v2/auth/grant/sub-key/{sub}
+func (s *Server) handleGrant(req *Request, path []string, r *http.Request) (int, interface{}) {
+	req.Channel = req.Query.Get("channel")
+
+	if status, body := s.checkPAM(path[4], r, nil); status != http.StatusOK {
+		return status, body
+	}
+
+	g := Grant{
+		R: atoi(req.Query.Get("r")),
+		W: atoi(req.Query.Get("w")),
+		M: atoi(req.Query.Get("m")),
+	}
+	g.TTL = 1440
+	if ttl := req.Query.Get("ttl"); ttl != "" {
+		g.TTL = atoi(ttl)
+	}
+
+	auth := req.Query.Get("auth")
+	s.mu.Lock()
+	if s.grants[req.Channel] == nil {
+		s.grants[req.Channel] = make(map[string]Grant)
+	}
+	if g.R == 0 && g.W == 0 && g.M == 0 {
+		delete(s.grants[req.Channel], auth)
+	} else {
+		s.grants[req.Channel][auth] = g
+	}
+	s.mu.Unlock()
+
+	return http.StatusOK, map[string]interface{}{
+		"status":  200,
+		"message": "Success",
+		"service": "Access Manager",
+		"payload": map[string]interface{}{
+			"level":         "user",
+			"subscribe_key": s.SubscribeKey,
+			"channel":       req.Channel,
+			"ttl":           g.TTL,
+			"auths":         map[string]Grant{auth: g},
+		},
+	}
+}
+
+// /v2/auth/audit/sub-key/{sub}
+func (s *Server) handleAudit(req *Request, path []string, r *http.Request) (int, interface{}) {
+	req.Channel = req.Query.Get("channel")
+
+	if status, body := s.checkPAM(path[4], r, nil); status != http.StatusOK {
+		return status, body
+	}
+
+	auth := req.Query.Get("auth")
+	channels := make(map[string]interface{})
+	s.mu.Lock()
+	for channel, grants := range s.grants {
+		if req.Channel != "" && channel != req.Channel {
+			continue
+		}
+		auths := make(map[string]Grant)
+		for a, g := range grants {
+			if auth == "" || a == auth {
+				auths[a] = g
+			}
+		}
+		channels[channel] = map[string]interface{}{"auths": auths}
+	}
+	s.mu.Unlock()
+
+	level := "subkey"
+	if req.Channel != "" {
+		level = "channel"
+	}
+
+	return http.StatusOK, map[string]interface{}{
+		"status":  200,
+		"message": "Success",
+		"service": "Access Manager",
+		"payload": map[string]interface{}{
+			"level":         level,
+			"subscribe_key": s.SubscribeKey,
+			"channels":      channels,
+		},
+	}
+}
+
+// /v2/history/sub-key/{sub}/channel/{channel}
+func (s *Server) handleHistory(req *Request, path []string, r *http.Request) (int, interface{}) {
+	channel, _ := url.PathUnescape(path[5])
+	req.Channel = channel
+
+	if path[3] != s.SubscribeKey {
+		return http.StatusBadRequest, errorBody(400, "Invalid Subscribe Key")
+	}
+
+	messages := s.History(channel)
+	if count := atoi(req.Query.Get("count")); count > 0 && count < len(messages) {
+		messages = messages[len(messages)-count:]
+	}
+
+	list := make([]json.RawMessage, 0, len(messages))
+	var start, end int64
+	for i, m := range messages {
+		list = append(list, m.Message)
+		if i == 0 {
+			start = m.Timetoken
+		}
+		end = m.Timetoken
+	}
+
+	return http.StatusOK, []interface{}{list, start, end}
+}
+
+// /time/0
+func (s *Server) handleTime(req *Request, path []string, r *http.Request) (int, interface{}) {
+	return http.StatusOK, []int64{s.nextTimetoken()}
+}
+
+// checkPAM verifies the keys and signature of Access Manager requests.
+func (s *Server) checkPAM(subscribeKey string, r *http.Request, body []byte) (int, interface{}) {
+	if subscribeKey != s.SubscribeKey {
+		return http.StatusBadRequest, errorBody(400, "Invalid Subscribe Key")
+	}
+	if s.SecretKey == "" {
+		return http.StatusForbidden, errorBody(403, "Access Manager requires a secret key")
+	}
+	return s.verify(r, body)
+}
+
+// verify checks the timestamp and v2 signature of a request.
+func (s *Server) verify(r *http.Request, body []byte) (int, interface{}) {
+	if !s.checkTimestamp(r) {
+		return http.StatusForbidden, errorBody(403, "Request timestamp is out of range")
+	}
+
+	query := r.URL.Query()
+	signature := query.Get("signature")
+	query.Del("signature")
+
+	// The path is signed as sent
+	path := r.RequestURI
+	if i := strings.IndexByte(path, '?'); i >= 0 {
+		path = path[:i]
+	}
+
+	if signature != SignV2(s.SecretKey, r.Method+"\n"+s.PublishKey+"\n"+path+"\n"+EncodeQuery(query)+"\n"+string(body)) {
+		return http.StatusForbidden, errorBody(403, "Invalid Signature")
+	}
+	return http.StatusOK, nil
+}
+
+// checkTimestamp verifies the timestamp of signed requests against the server clock.
+func (s *Server) checkTimestamp(r *http.Request) bool {
+	timestamp, err := strconv.ParseInt(r.URL.Query().Get("timestamp"), 10, 64)
+	if err != nil {
+		return false
+	}
+	s.mu.Lock()
+	now := time.Now().Add(s.offset)
+	s.mu.Unlock()
+	skew := now.Sub(time.Unix(timestamp, 0))
+	return skew <= MaxSkew && skew >= -MaxSkew
+}
+
+// SignV2 is the PubNub v2 signature of the string to sign.
+func SignV2(secretKey, input string) string {
+	mac := hmac.New(sha256.New, []byte(secretKey))
+	mac.Write([]byte(input))
+	return "v2." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// EncodeQuery is the canonical query of signatures: sorted by key, spaces
+// as %20 and only the RFC 3986 unreserved characters unescaped.
+func EncodeQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var params []string
+	for _, k := range keys {
+		for _, v := range query[k] {
+			params = append(params, escape(k)+"="+escape(v))
+		}
+	}
+	return strings.Join(params, "&")
+}
+
+// escape is written independently of the client encoding on purpose,
+// byte by byte from RFC 3986.
+func escape(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || c == '-' || c == '.' || c == '_' || c == '~' {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// sleep waits for d or until the client goes away.
+func sleep(r *http.Request, d time.Duration) {
+	if d <= 0 {
+		return
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+	case <-r.Context().Done():
+	}
+}
+
+func errorBody(status int, message string) map[string]interface{} {
+	return map[string]interface{}{
+		"status":  status,
+		"error":   true,
+		"message": message,
+	}
+}
+
+func atoi(s string) int {
+	i, _ := strconv.Atoi(s)
+	return i
+}
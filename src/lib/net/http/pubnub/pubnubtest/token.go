@@ -0,0 +1,230 @@
+package pubnubtest
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/url"
+	"sort"
+	"time"
+)
+
+// Token endpoints
+const (
+	EndpointGrantToken  = "grant-token"
+	EndpointRevokeToken = "revoke-token"
+)
+
+// TokenRequest is the body of a grant token request.
+type TokenRequest struct {
+	TTL         int `json:"ttl"`
+	Permissions struct {
+		Resources map[string]map[string]int `json:"resources"`
+		Patterns  map[string]map[string]int `json:"patterns"`
+		Meta      map[string]interface{}    `json:"meta"`
+		UUID      string                    `json:"uuid"`
+	} `json:"permissions"`
+}
+
+// Tokens returns the granted tokens not revoked.
+func (s *Server) Tokens() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var tokens []string
+	for token, revoked := range s.tokens {
+		if !revoked {
+			tokens = append(tokens, token)
+		}
+	}
+	sort.Strings(tokens)
+	return tokens
+}
+
+// revoked reports whether token was granted then revoked.
+func (s *Server) revoked(token string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.tokens[token]
+}
+
+// POST /v3/pam/{sub}/grant
+func (s *Server) handleGrantToken(req *Request, path []string, r *http.Request) (int, interface{}) {
+	body, _ := ioutil.ReadAll(r.Body)
+
+	if status, resp := s.checkPAM(path[2], r, body); status != http.StatusOK {
+		return status, resp
+	}
+
+	var grant TokenRequest
+	if err := json.Unmarshal(body, &grant); err != nil {
+		return http.StatusBadRequest, errorBody(400, "Invalid JSON")
+	}
+	if grant.TTL < 1 || grant.TTL > 43200 {
+		return http.StatusBadRequest, errorBody(400, "Invalid ttl")
+	}
+
+	resources := func(m map[string]map[string]int) map[string]interface{} {
+		names := map[string]string{"channels": "chan", "groups": "grp", "uuids": "uuid", "users": "usr", "spaces": "spc"}
+		res := make(map[string]interface{})
+		for key, short := range names {
+			perms := make(map[string]interface{})
+			for name, bits := range m[key] {
+				perms[name] = int64(bits)
+			}
+			res[short] = perms
+		}
+		return res
+	}
+
+	s.mu.Lock()
+	now := time.Now().Add(s.offset).Unix()
+	s.mu.Unlock()
+
+	token := map[string]interface{}{
+		"v":    int64(2),
+		"t":    now,
+		"ttl":  int64(grant.TTL),
+		"res":  resources(grant.Permissions.Resources),
+		"pat":  resources(grant.Permissions.Patterns),
+		"meta": grant.Permissions.Meta,
+	}
+	if token["meta"] == nil {
+		token["meta"] = map[string]interface{}{}
+	}
+	if grant.Permissions.UUID != "" {
+		token["uuid"] = grant.Permissions.UUID
+	}
+
+	unsigned := encodeCBOR(token)
+	mac := hmac.New(sha256.New, []byte(s.SecretKey))
+	mac.Write(unsigned)
+	token["sig"] = mac.Sum(nil)
+
+	encoded := base64.RawURLEncoding.EncodeToString(encodeCBOR(token))
+	s.mu.Lock()
+	s.tokens[encoded] = false
+	s.mu.Unlock()
+
+	return http.StatusOK, map[string]interface{}{
+		"status":  200,
+		"service": "Access Manager",
+		"data": map[string]interface{}{
+			"message": "Success",
+			"token":   encoded,
+		},
+	}
+}
+
+// DELETE /v3/pam/{sub}/grant/{token}
+func (s *Server) handleRevokeToken(req *Request, path []string, r *http.Request) (int, interface{}) {
+	if status, resp := s.checkPAM(path[2], r, nil); status != http.StatusOK {
+		return status, resp
+	}
+
+	token, _ := url.PathUnescape(path[4])
+	s.mu.Lock()
+	_, found := s.tokens[token]
+	if found {
+		s.tokens[token] = true
+	}
+	s.mu.Unlock()
+
+	if !found {
+		return http.StatusBadRequest, errorBody(400, "Invalid token")
+	}
+
+	return http.StatusOK, map[string]interface{}{
+		"status":  200,
+		"service": "Access Manager",
+		"data":    map[string]interface{}{"message": "Success"},
+	}
+}
+
+// encodeCBOR encodes maps (with sorted keys), lists, strings, byte strings,
+// integers, floats, booleans and nil.
+func encodeCBOR(v interface{}) []byte {
+	var buf bytes.Buffer
+	writeCBOR(&buf, v)
+	return buf.Bytes()
+}
+
+func writeCBORHeader(buf *bytes.Buffer, major byte, n uint64) {
+	switch {
+	case n < 24:
+		buf.WriteByte(major<<5 | byte(n))
+	case n <= math.MaxUint8:
+		buf.WriteByte(major<<5 | 24)
+		buf.WriteByte(byte(n))
+	case n <= math.MaxUint16:
+		buf.WriteByte(major<<5 | 25)
+		binary.Write(buf, binary.BigEndian, uint16(n))
+	case n <= math.MaxUint32:
+		buf.WriteByte(major<<5 | 26)
+		binary.Write(buf, binary.BigEndian, uint32(n))
+	default:
+		buf.WriteByte(major<<5 | 27)
+		binary.Write(buf, binary.BigEndian, n)
+	}
+}
+
+func writeCBOR(buf *bytes.Buffer, v interface{}) {
+	switch value := v.(type) {
+	case nil:
+		buf.WriteByte(0xf6)
+	case bool:
+		if value {
+			buf.WriteByte(0xf5)
+		} else {
+			buf.WriteByte(0xf4)
+		}
+	case int64:
+		if value < 0 {
+			writeCBORHeader(buf, 1, uint64(-1-value))
+		} else {
+			writeCBORHeader(buf, 0, uint64(value))
+		}
+	case int:
+		writeCBOR(buf, int64(value))
+	case float64:
+		if value == math.Trunc(value) && math.Abs(value) < 1<<53 {
+			writeCBOR(buf, int64(value))
+			return
+		}
+		buf.WriteByte(0xfb)
+		binary.Write(buf, binary.BigEndian, math.Float64bits(value))
+	case string:
+		writeCBORHeader(buf, 3, uint64(len(value)))
+		buf.WriteString(value)
+	case []byte:
+		writeCBORHeader(buf, 2, uint64(len(value)))
+		buf.Write(value)
+	case []interface{}:
+		writeCBORHeader(buf, 4, uint64(len(value)))
+		for _, item := range value {
+			writeCBOR(buf, item)
+		}
+	case map[string]interface{}:
+		keys := make([]string, 0, len(value))
+		for k := range value {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		writeCBORHeader(buf, 5, uint64(len(keys)))
+		for _, k := range keys {
+			writeCBOR(buf, k)
+			writeCBOR(buf, value[k])
+		}
+	default:
+		// Values decoded from json
+		b, _ := json.Marshal(value)
+		var decoded interface{}
+		json.Unmarshal(b, &decoded)
+		writeCBOR(buf, decoded)
+	}
+}
@@ -0,0 +1,85 @@
+package pubnub
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Signer builds the PubNub v2 request signature:
+//
+//	"v2." + base64url(HMAC-SHA256(secret, method\npublishKey\npath\nquery\nbody))
+//
+// path is sent as is and query is the canonical query: sorted by key and
+// percent-encoded by EncodeQuery. The request must carry exactly the query
+// returned by SignedQuery, re-encoding it differently breaks the signature.
+type Signer struct {
+	PublishKey string
+	SecretKey  string
+}
+
+// StringToSign returns the signed input of a request.
+func (s *Signer) StringToSign(method string, path string, query url.Values, body []byte) string {
+	return method + "\n" + s.PublishKey + "\n" + path + "\n" + EncodeQuery(query) + "\n" + string(body)
+}
+
+// Sign returns the signature of a request, query must not contain the signature.
+func (s *Signer) Sign(method string, path string, query url.Values, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(s.SecretKey))
+	mac.Write([]byte(s.StringToSign(method, path, query, body)))
+	return "v2." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// SignedQuery returns the canonical query followed by its signature.
+func (s *Signer) SignedQuery(method string, path string, query url.Values, body []byte) string {
+	return EncodeQuery(query) + "&signature=" + s.Sign(method, path, query, body)
+}
+
+// EncodeQuery sorts the query by key and percent-encodes it the PubNub way:
+// unreserved characters are kept, spaces are %20 and everything else is escaped.
+func EncodeQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var params []string
+	for _, k := range keys {
+		for _, v := range query[k] {
+			params = append(params, Escape(k)+"="+Escape(v))
+		}
+	}
+	return strings.Join(params, "&")
+}
+
+// Escape percent-encodes a query value or path segment, only the RFC 3986
+// unreserved characters (letters, digits, "-", ".", "_" and "~") are kept.
+func Escape(s string) string {
+	return strings.NewReplacer("+", "%20", "*", "%2A").Replace(url.QueryEscape(s))
+}
+
+// signedURL adds the sdk, uuid, timestamp and signature parameters to a
+// request path, requests are not signed without a secret key.
+func (pub *Pubnub) signedURL(ctx context.Context, method string, path string, query url.Values, body []byte) string {
+	if query == nil {
+		query = url.Values{}
+	}
+	query.Set(sdkIdentificationParamKey, sdkIdentificationParamVal)
+	if pub.uuid != "" {
+		query.Set("uuid", pub.uuid)
+	}
+
+	if pub.secretKey == "" {
+		return path + "?" + EncodeQuery(query)
+	}
+
+	query.Set("timestamp", strconv.FormatInt(pub.timestamp(ctx), 10))
+	signer := &Signer{PublishKey: pub.publishKey, SecretKey: pub.secretKey}
+	return path + "?" + signer.SignedQuery(method, path, query, body)
+}
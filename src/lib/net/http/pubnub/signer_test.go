@@ -0,0 +1,93 @@
+package pubnub
+
+import (
+	"net/url"
+	"testing"
+)
+
+// Vectors computed independently with HMAC-SHA256 over the string to sign.
+var signatureVectors = []struct {
+	method string
+	path   string
+	query  url.Values
+	body   string
+	input  string
+	sign   string
+}{
+	{
+		"GET", "/v2/auth/grant/sub-key/demo",
+		url.Values{
+			"auth": {"key 1"}, "channel": {"a+b,c*d~e"}, "pnsdk": {"PubNub-Go/3.16.1"},
+			"r": {"1"}, "w": {"1"}, "ttl": {"60"}, "timestamp": {"1600000000"},
+		},
+		"",
+		"GET\ndemo\n/v2/auth/grant/sub-key/demo\nauth=key%201&channel=a%2Bb%2Cc%2Ad~e&pnsdk=PubNub-Go%2F3.16.1&r=1&timestamp=1600000000&ttl=60&w=1\n",
+		"v2.WOskVqRKvrIq-NGnIg_XmeQUHlqLcL4evIQlF_qbkBU",
+	},
+	{
+		"POST", "/v3/pam/demo/grant",
+		url.Values{"timestamp": {"123456789"}, "PoundsSterling": {"£13.37"}},
+		`{"ttl":1440}`,
+		"POST\ndemo\n/v3/pam/demo/grant\nPoundsSterling=%C2%A313.37&timestamp=123456789\n{\"ttl\":1440}",
+		"v2.5dWASoGOZZmfgUrxIx6xMcqOmp5MSuP23cHvqxCbfME",
+	},
+	{
+		"GET", "/publish/demo/demo/0/caf%C3%A9%20%26%20bar/0/%7B%22a%22:1%7D",
+		url.Values{"uuid": {"u*1"}, "pnsdk": {"PubNub-Go/3.16.1"}, "timestamp": {"1600000000"}},
+		"",
+		"GET\ndemo\n/publish/demo/demo/0/caf%C3%A9%20%26%20bar/0/%7B%22a%22:1%7D\npnsdk=PubNub-Go%2F3.16.1&timestamp=1600000000&uuid=u%2A1\n",
+		"v2.AKB1zjLSUARhGDjC6r5CRV04WEFjPwKfk6DqmdVXQQ0",
+	},
+}
+
+func TestSigner(t *testing.T) {
+	signer := &Signer{PublishKey: "demo", SecretKey: "wMfbo9G0xVUG8yfTfYw5qIdfJkTd7A"}
+
+	for _, v := range signatureVectors {
+		if input := signer.StringToSign(v.method, v.path, v.query, []byte(v.body)); input != v.input {
+			t.Errorf("%s %s: expected string to sign %q got %q", v.method, v.path, v.input, input)
+		}
+		if sign := signer.Sign(v.method, v.path, v.query, []byte(v.body)); sign != v.sign {
+			t.Errorf("%s %s: expected %s got %s", v.method, v.path, v.sign, sign)
+		}
+	}
+}
+
+func TestEscape(t *testing.T) {
+	tests := map[string]string{
+		"orders":      "orders",
+		"a b":         "a%20b",
+		"a+b":         "a%2Bb",
+		"a*b~c-d.e_f": "a%2Ab~c-d.e_f",
+		"a/b?c#d&e=f": "a%2Fb%3Fc%23d%26e%3Df",
+		"café":        "caf%C3%A9",
+	}
+	for s, expected := range tests {
+		if escaped := Escape(s); escaped != expected {
+			t.Errorf("Escape(%q) expected %s got %s", s, expected, escaped)
+		}
+	}
+}
+
+// Channels escaped differently by url.QueryEscape and url.Values.Encode
+func TestSignedChannels(t *testing.T) {
+	pubnub, srv := newTestPubnub(t)
+
+	for _, channel := range []string{"a b", "a+b", "a*b", "a~b", "café & bar", "a,b;c:d"} {
+		if _, err := pubnub.Publish(channel, `{"id":1}`, "", true); err != nil {
+			t.Errorf("Publish %q %s", channel, err)
+		}
+		if len(srv.History(channel)) != 1 {
+			t.Errorf("Expected message on %q", channel)
+		}
+		if _, err := pubnub.Grant(channel, "auth key+1", true, false, 60); err != nil {
+			t.Errorf("Grant %q %s", channel, err)
+		}
+		if g := srv.Grants(channel)["auth key+1"]; g.R != 1 || g.W != 0 {
+			t.Errorf("Unexpected grant %+v on %q", g, channel)
+		}
+		if _, err := pubnub.Audit(channel, "auth key+1"); err != nil {
+			t.Errorf("Audit %q %s", channel, err)
+		}
+	}
+}
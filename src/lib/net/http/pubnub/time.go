@@ -0,0 +1,98 @@
+package pubnub
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// Time returns the PubNub server time as a timetoken (100ns since epoch).
+func (pub *Pubnub) Time() (int64, error) {
+	return pub.TimeContext(context.Background())
+}
+
+// TimeContext is Time aborted when ctx is done.
+func (pub *Pubnub) TimeContext(ctx context.Context) (int64, error) {
+	value, responseCode, err := pub.httpRequest(ctx, "/time/0?"+sdkIdentificationParam, false)
+	if err != nil {
+		return 0, fmt.Errorf("Time Error Internal: %w", err)
+	}
+	if responseCode != 200 {
+		return 0, newAPIError(responseCode, value)
+	}
+
+	var response []json.Number
+	if err := json.Unmarshal(value, &response); err != nil || len(response) != 1 {
+		return 0, fmt.Errorf("Time Error Message: %s", value)
+	}
+	return strconv.ParseInt(response[0].String(), 10, 64)
+}
+
+// WithClockSync signs requests with the server time: the clock offset is
+// measured every interval and logged when larger than threshold. The sync
+// is lazy, the first signed request after each interval measures it first.
+func WithClockSync(interval time.Duration, threshold time.Duration) Option {
+	return func(pub *Pubnub) {
+		pub.clockSync = interval
+		pub.clockThreshold = threshold
+	}
+}
+
+// SyncClock measures the offset between the local clock and PubNub,
+// the offset is used by signatures when clock sync is enabled.
+func (pub *Pubnub) SyncClock(ctx context.Context) (time.Duration, error) {
+	start := time.Now()
+	timetoken, err := pub.TimeContext(ctx)
+	if err != nil {
+		return 0, err
+	}
+	rtt := time.Since(start)
+
+	// Server time is assumed halfway through the request
+	server := time.Unix(0, timetoken*100)
+	offset := server.Sub(start.Add(rtt / 2))
+
+	pub.clockLock.Lock()
+	pub.clockOffset = offset
+	pub.clockSynced = time.Now()
+	pub.clockLock.Unlock()
+
+	if pub.clockThreshold > 0 && (offset > pub.clockThreshold || offset < -pub.clockThreshold) {
+		pub.log(LevelWarn, "Clock drift from PubNub exceeds threshold", "offset", offset.Round(time.Millisecond), "threshold", pub.clockThreshold)
+	}
+
+	return offset, nil
+}
+
+// ClockOffset returns the last measured offset from PubNub.
+func (pub *Pubnub) ClockOffset() time.Duration {
+	pub.clockLock.Lock()
+	defer pub.clockLock.Unlock()
+	return pub.clockOffset
+}
+
+// timestamp returns the unix time used to sign requests, synchronized
+// with PubNub when clock sync is enabled.
+func (pub *Pubnub) timestamp(ctx context.Context) int64 {
+	if pub.clockSync <= 0 {
+		return time.Now().Unix()
+	}
+
+	// Concurrent requests keep the current offset during the sync
+	pub.clockLock.Lock()
+	stale := time.Since(pub.clockSynced) > pub.clockSync
+	if stale {
+		pub.clockSynced = time.Now()
+	}
+	pub.clockLock.Unlock()
+
+	if stale {
+		if _, err := pub.SyncClock(ctx); err != nil {
+			pub.log(LevelWarn, "Clock sync failed", "error", err)
+		}
+	}
+
+	return time.Now().Add(pub.ClockOffset()).Unix()
+}
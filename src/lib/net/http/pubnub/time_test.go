@@ -0,0 +1,110 @@
+package pubnub
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"lib/net/http/pubnub/pubnubtest"
+)
+
+func TestTime(t *testing.T) {
+	pubnub, _ := newTestPubnub(t)
+
+	timetoken, err := pubnub.Time()
+	if err != nil {
+		t.Fatalf("Time %s", err)
+	}
+	if d := time.Since(time.Unix(0, timetoken*100)); d > time.Second || d < -time.Second {
+		t.Errorf("Unexpected timetoken %d", timetoken)
+	}
+}
+
+func TestClockSync(t *testing.T) {
+	srv := pubnubtest.NewServer(testPublishKey, testSubscribeKey, testSecretKey)
+	defer srv.Close()
+	srv.SetClockOffset(-10 * time.Minute)
+
+	// Without sync the drifted local clock is rejected
+	pubnub := New(testPublishKey, testSubscribeKey, testSecretKey, "", false, "", WithOrigin(srv.URL))
+	if _, err := pubnub.Grant("console", "auth", true, false, 60); !errors.Is(err, ErrAuth) {
+		t.Errorf("Expected %s got %v", ErrAuth, err)
+	}
+
+	logger := &testLogger{}
+	pubnub = New(testPublishKey, testSubscribeKey, testSecretKey, "", false, "",
+		WithOrigin(srv.URL),
+		WithClockSync(time.Hour, time.Minute),
+		WithLogger(logger),
+	)
+	if _, err := pubnub.Grant("console", "auth", true, false, 60); err != nil {
+		t.Errorf("Grant %s", err)
+	}
+	if _, err := pubnub.Publish("console", `{"id":1}`, "", false); err != nil {
+		t.Errorf("Publish %s", err)
+	}
+
+	if offset := pubnub.ClockOffset(); offset > -9*time.Minute || offset < -11*time.Minute {
+		t.Errorf("Unexpected offset %s", offset)
+	}
+	if len(logger.lines) != 1 {
+		t.Errorf("Expected one drift warning got %q", logger.lines)
+	}
+	if n := srv.Count(pubnubtest.EndpointTime, 0); n != 1 {
+		t.Errorf("Expected one sync got %d", n)
+	}
+
+	if _, err := pubnub.SyncClock(context.Background()); err != nil {
+		t.Errorf("SyncClock %s", err)
+	}
+}
+
+type testLogger struct {
+	lines []string
+}
+
+func (l *testLogger) Printf(format string, v ...interface{}) {
+	l.lines = append(l.lines, fmt.Sprintf(format, v...))
+}
+
+type levelLogger struct {
+	testLogger
+	levels []Level
+}
+
+func (l *levelLogger) Log(level Level, msg string, kv ...interface{}) {
+	l.levels = append(l.levels, level)
+}
+
+func TestLog(t *testing.T) {
+	pubnub, _ := newTestPubnub(t)
+
+	// Debug messages are dropped by plain loggers
+	plain := &testLogger{}
+	pubnub.logger = plain
+	if _, err := pubnub.Audit("console", ""); err != nil {
+		t.Fatalf("Audit %s", err)
+	}
+	pubnub.log(LevelWarn, "Warning", "key", "value")
+	if len(plain.lines) != 1 || plain.lines[0] != "Warning key=value" {
+		t.Errorf("Unexpected lines %q", plain.lines)
+	}
+
+	leveled := &levelLogger{}
+	pubnub.logger = leveled
+	if _, err := pubnub.Audit("console", ""); err != nil {
+		t.Fatalf("Audit %s", err)
+	}
+	if len(leveled.levels) != 1 || leveled.levels[0] != LevelDebug {
+		t.Errorf("Expected the audit response at debug level got %v", leveled.levels)
+	}
+
+	if l, err := ParseLevel("WARN"); err != nil || l != LevelWarn || l.String() != "warn" {
+		t.Errorf("ParseLevel %v %v", l, err)
+	}
+	if _, err := ParseLevel("verbose"); err == nil {
+		t.Errorf("Expected unknown level error")
+	}
+}
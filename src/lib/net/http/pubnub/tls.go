@@ -0,0 +1,109 @@
+package pubnub
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/ioutil"
+)
+
+// TLSConfig configures the verification of PubNub connections.
+// Certificates are always verified unless Insecure is set.
+type TLSConfig struct {
+	CAFile     string   // PEM bundle used instead of the system roots
+	Pins       []string // Base64 SHA-256 of accepted certificate public keys (SPKI)
+	MinVersion uint16   // Minimum TLS version, defaults to TLS 1.2
+	Insecure   bool     // Skip verification, for testing only
+}
+
+// ErrPinMismatch is returned when no certificate of the chain matches the configured pins.
+var ErrPinMismatch = errors.New("pubnub: certificate does not match any pin")
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// ParseTLSVersion converts "1.0" to "1.3" to the tls package version.
+func ParseTLSVersion(version string) (uint16, error) {
+	if version == "" {
+		return 0, nil
+	}
+	v, found := tlsVersions[version]
+	if !found {
+		return 0, fmt.Errorf("pubnub: unknown TLS version %q", version)
+	}
+	return v, nil
+}
+
+// Build returns the tls.Config for the settings.
+func (c *TLSConfig) Build() (*tls.Config, error) {
+	config := &tls.Config{MinVersion: tls.VersionTLS12}
+	if c == nil {
+		return config, nil
+	}
+
+	if c.MinVersion != 0 {
+		config.MinVersion = c.MinVersion
+	}
+
+	if c.Insecure {
+		config.InsecureSkipVerify = true
+		return config, nil
+	}
+
+	if c.CAFile != "" {
+		pem, err := ioutil.ReadFile(c.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("pubnub: read CA file: %s", err)
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("pubnub: no certificate found in %q", c.CAFile)
+		}
+	}
+
+	if len(c.Pins) > 0 {
+		pins := make(map[string]bool, len(c.Pins))
+		for _, pin := range c.Pins {
+			pins[pin] = true
+		}
+		config.VerifyConnection = func(state tls.ConnectionState) error {
+			for _, cert := range state.PeerCertificates {
+				if pins[spkiHash(cert)] {
+					return nil
+				}
+			}
+			return ErrPinMismatch
+		}
+	}
+
+	return config, nil
+}
+
+// spkiHash returns the base64 SHA-256 of the certificate public key, the pin format.
+func spkiHash(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// SetTLS replaces the TLS settings used by new connections.
+func (pub *Pubnub) SetTLS(c *TLSConfig) error {
+	config, err := c.Build()
+	if err != nil {
+		return err
+	}
+
+	pub.Lock()
+	defer pub.Unlock()
+	pub.tlsConfig = config
+	if !pub.customClient {
+		pub.client = nil
+	}
+	return nil
+}
@@ -0,0 +1,68 @@
+package pubnub
+
+import (
+	"context"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestTLS(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "[15000000000000000]")
+	}))
+	defer srv.Close()
+
+	dir, err := ioutil.TempDir("", "pubnub")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	caFile := filepath.Join(dir, "ca.pem")
+	caPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw})
+	if err := ioutil.WriteFile(caFile, caPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		tls   *TLSConfig
+		valid bool
+	}{
+		{"system roots", nil, false},
+		{"ca file", &TLSConfig{CAFile: caFile}, true},
+		{"ca file and pin", &TLSConfig{CAFile: caFile, Pins: []string{spkiHash(srv.Certificate())}}, true},
+		{"wrong pin", &TLSConfig{CAFile: caFile, Pins: []string{"AAAA"}}, false},
+		{"insecure", &TLSConfig{Insecure: true}, true},
+	}
+
+	for _, test := range tests {
+		lib := NewClient("pub", "sub", WithOrigin(srv.URL))
+		if err := lib.SetTLS(test.tls); err != nil {
+			t.Fatalf("%s: SetTLS %s", test.name, err)
+		}
+
+		_, _, err := lib.httpRequest(context.Background(), "/time/0", false)
+		if (err == nil) != test.valid {
+			t.Errorf("%s: unexpected result %v", test.name, err)
+		}
+		if test.name == "wrong pin" && !errors.Is(err, ErrPinMismatch) {
+			t.Errorf("%s: expected %s got %v", test.name, ErrPinMismatch, err)
+		}
+		// Certificate and pin failures are not retried
+		if err != nil && Retryable(err) {
+			t.Errorf("%s: expected %v not retryable", test.name, err)
+		}
+	}
+
+	if _, err := (&TLSConfig{CAFile: filepath.Join(dir, "missing.pem")}).Build(); err == nil {
+		t.Errorf("Expected error for missing CA file")
+	}
+}
@@ -0,0 +1,115 @@
+package pubnub
+
+import (
+	"encoding/base64"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestGrantToken(t *testing.T) {
+	pubnub, srv := newTestPubnub(t)
+
+	token, err := pubnub.GrantToken(&TokenRequest{
+		TTL:            60,
+		AuthorizedUUID: "client-1",
+		Resources: TokenResources{
+			Channels: map[string]Permission{"orders": PermRead | PermWrite},
+			UUIDs:    map[string]Permission{"client-1": PermGet | PermUpdate},
+		},
+		Patterns: TokenResources{
+			Channels: map[string]Permission{"^orders-.*$": PermRead},
+		},
+		Meta: map[string]interface{}{"user": "bob"},
+	})
+	if err != nil {
+		t.Fatalf("GrantToken %s", err)
+	}
+
+	parsed, err := ParseToken(token)
+	if err != nil {
+		t.Fatalf("ParseToken %s", err)
+	}
+	if parsed.Version != 2 || parsed.TTL != 60 || parsed.AuthorizedUUID != "client-1" || len(parsed.Signature) == 0 {
+		t.Errorf("Unexpected token %+v", parsed)
+	}
+	if p := parsed.Resources.Channels["orders"]; p != PermRead|PermWrite || p.String() != "rw" {
+		t.Errorf("Unexpected channel rights %s", p)
+	}
+	if p := parsed.Resources.UUIDs["client-1"]; p != PermGet|PermUpdate {
+		t.Errorf("Unexpected uuid rights %s", p)
+	}
+	if p := parsed.Patterns.Channels["^orders-.*$"]; p != PermRead {
+		t.Errorf("Unexpected pattern rights %s", p)
+	}
+	if parsed.Meta["user"] != "bob" {
+		t.Errorf("Unexpected meta %v", parsed.Meta)
+	}
+	if d := time.Until(parsed.Expires()); d < 59*time.Minute || d > 61*time.Minute {
+		t.Errorf("Unexpected expiry %s", parsed.Expires())
+	}
+
+	// Token based publishing
+	if _, err := pubnub.Publish("orders", `{"id":1}`, token, false); err != nil {
+		t.Errorf("Publish %s", err)
+	}
+	if auth := srv.Requests()[1].Query.Get("auth"); auth != token {
+		t.Errorf("Expected the token as auth got %q", auth)
+	}
+
+	if err := pubnub.RevokeToken(token); err != nil {
+		t.Fatalf("RevokeToken %s", err)
+	}
+	if _, err := pubnub.Publish("orders", `{"id":1}`, token, false); !errors.Is(err, ErrAuth) {
+		t.Errorf("Expected %s with a revoked token got %v", ErrAuth, err)
+	}
+	if len(srv.Tokens()) != 0 {
+		t.Errorf("Expected no active token got %v", srv.Tokens())
+	}
+
+	if _, err := pubnub.GrantToken(&TokenRequest{TTL: 0}); !errors.Is(err, ErrValidation) {
+		t.Errorf("Expected %s for ttl 0 got %v", ErrValidation, err)
+	}
+}
+
+func TestParseToken(t *testing.T) {
+	// {"v":2,"t":1619718521,"ttl":15,"res":{"chan":{"ch1":3}},"pat":{},"meta":{},"sig":h'0102'}
+	data := []byte{
+		0xa7,
+		0x61, 'v', 0x02,
+		0x61, 't', 0x1a, 0x60, 0x8a, 0xd4, 0x79,
+		0x63, 't', 't', 'l', 0x0f,
+		0x63, 'r', 'e', 's', 0xa1, 0x64, 'c', 'h', 'a', 'n', 0xa1, 0x63, 'c', 'h', '1', 0x03,
+		0x63, 'p', 'a', 't', 0xa0,
+		0x64, 'm', 'e', 't', 'a', 0xa0,
+		0x63, 's', 'i', 'g', 0x42, 0x01, 0x02,
+	}
+
+	for _, encoding := range []*base64.Encoding{base64.RawURLEncoding, base64.StdEncoding} {
+		token, err := ParseToken(encoding.EncodeToString(data))
+		if err != nil {
+			t.Fatalf("ParseToken %s", err)
+		}
+		if token.Timestamp != 1619711097 || token.TTL != 15 || token.Resources.Channels["ch1"] != PermRead|PermWrite {
+			t.Errorf("Unexpected token %+v", token)
+		}
+	}
+
+	// A byte string of 2^63-1 bytes
+	huge := []byte{0x5b, 0x7f, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}
+	for _, invalid := range []string{"", "!!!", base64.RawURLEncoding.EncodeToString(data[:20]), base64.RawURLEncoding.EncodeToString(huge)} {
+		if _, err := ParseToken(invalid); err == nil {
+			t.Errorf("Expected error for %q", invalid)
+		}
+	}
+}
+
+func TestParsePermission(t *testing.T) {
+	p, err := ParsePermission("rwmdguj")
+	if err != nil || p != 0xef {
+		t.Errorf("Unexpected permission %d : %v", p, err)
+	}
+	if _, err := ParsePermission("rx"); err == nil {
+		t.Errorf("Expected error for unknown right")
+	}
+}
@@ -0,0 +1,143 @@
+package pubnub
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"net/url"
+	"sync/atomic"
+	"time"
+)
+
+// TransportConfig tunes a transport shared by several instances, zero
+// fields use the defaults of DefaultTransportConfig.
+type TransportConfig struct {
+	TLS   *TLSConfig
+	Proxy *ProxyConfig
+
+	ConnectTimeout      time.Duration // Covers establishing a new TCP connection
+	KeepAlive           time.Duration // TCP keep-alive period
+	MaxIdleConns        int           // Idle connections kept, all hosts
+	MaxIdleConnsPerHost int           // Idle connections kept by host, eg. the origin
+	MaxConnsPerHost     int           // Connections by host, 0 is unlimited
+	IdleConnTimeout     time.Duration // Idle connections closed after
+	DisableHTTP2        bool          // Only HTTP/1.1
+}
+
+// DefaultTransportConfig are the settings of transports built by instances
+// without WithTransport.
+var DefaultTransportConfig = TransportConfig{
+	ConnectTimeout:      10 * time.Second,
+	KeepAlive:           30 * time.Second,
+	MaxIdleConns:        100,
+	MaxIdleConnsPerHost: 10,
+	IdleConnTimeout:     90 * time.Second,
+}
+
+// Transport is a keep-alive http.RoundTripper counting the connections
+// it opens and reuses, to share between instances with WithTransport.
+type Transport struct {
+	base *http.Transport
+
+	requests   int64
+	reused     int64
+	created    int64
+	handshakes int64
+}
+
+// TransportStats are the counters of a Transport.
+type TransportStats struct {
+	Requests      int64 `json:"requests"`       // Requests sent
+	Reused        int64 `json:"reused"`         // Requests sent on an idle connection
+	Created       int64 `json:"created"`        // Requests which opened a connection
+	TLSHandshakes int64 `json:"tls_handshakes"` // Completed TLS handshakes
+}
+
+// NewTransport builds a transport from c.
+func NewTransport(c *TransportConfig) (*Transport, error) {
+	tlsConfig, err := c.TLS.Build()
+	if err != nil {
+		return nil, err
+	}
+	proxy, err := c.Proxy.Func()
+	if err != nil {
+		return nil, err
+	}
+	return &Transport{base: newHTTPTransport(c, tlsConfig, proxy)}, nil
+}
+
+// newHTTPTransport fills the zero settings of c with the defaults.
+func newHTTPTransport(c *TransportConfig, tlsConfig *tls.Config, proxy func(*http.Request) (*url.URL, error)) *http.Transport {
+	d := DefaultTransportConfig
+	if c.ConnectTimeout > 0 {
+		d.ConnectTimeout = c.ConnectTimeout
+	}
+	if c.KeepAlive > 0 {
+		d.KeepAlive = c.KeepAlive
+	}
+	if c.MaxIdleConns > 0 {
+		d.MaxIdleConns = c.MaxIdleConns
+	}
+	if c.MaxIdleConnsPerHost > 0 {
+		d.MaxIdleConnsPerHost = c.MaxIdleConnsPerHost
+	}
+	if c.IdleConnTimeout > 0 {
+		d.IdleConnTimeout = c.IdleConnTimeout
+	}
+
+	return &http.Transport{
+		Proxy: proxy,
+		DialContext: (&net.Dialer{
+			Timeout:   d.ConnectTimeout,
+			KeepAlive: d.KeepAlive,
+		}).DialContext,
+		TLSClientConfig:     tlsConfig.Clone(),
+		TLSHandshakeTimeout: d.ConnectTimeout,
+		MaxIdleConns:        d.MaxIdleConns,
+		MaxIdleConnsPerHost: d.MaxIdleConnsPerHost,
+		MaxConnsPerHost:     c.MaxConnsPerHost,
+		IdleConnTimeout:     d.IdleConnTimeout,
+		// A custom dialer and TLS config disable HTTP/2 unless forced
+		ForceAttemptHTTP2: !c.DisableHTTP2,
+	}
+}
+
+// RoundTrip sends req, counting whether its connection was reused.
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	atomic.AddInt64(&t.requests, 1)
+
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			if info.Reused {
+				atomic.AddInt64(&t.reused, 1)
+			} else {
+				atomic.AddInt64(&t.created, 1)
+			}
+		},
+		TLSHandshakeDone: func(_ tls.ConnectionState, err error) {
+			if err == nil {
+				atomic.AddInt64(&t.handshakes, 1)
+			}
+		},
+	}
+	ctx := httptrace.WithClientTrace(req.Context(), trace)
+
+	return t.base.RoundTrip(req.WithContext(ctx))
+}
+
+// CloseIdleConnections closes the idle connections, the next requests
+// open new ones.
+func (t *Transport) CloseIdleConnections() {
+	t.base.CloseIdleConnections()
+}
+
+// Stats returns the counters of the transport.
+func (t *Transport) Stats() TransportStats {
+	return TransportStats{
+		Requests:      atomic.LoadInt64(&t.requests),
+		Reused:        atomic.LoadInt64(&t.reused),
+		Created:       atomic.LoadInt64(&t.created),
+		TLSHandshakes: atomic.LoadInt64(&t.handshakes),
+	}
+}
@@ -0,0 +1,66 @@
+package pubnub
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+)
+
+func TestSharedTransport(t *testing.T) {
+	var http2 int64
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ProtoMajor == 2 {
+			atomic.AddInt64(&http2, 1)
+		}
+		fmt.Fprint(w, "[15000000000000000]")
+	}))
+	srv.EnableHTTP2 = true
+	srv.StartTLS()
+	defer srv.Close()
+
+	for _, disableHTTP2 := range []bool{false, true} {
+		atomic.StoreInt64(&http2, 0)
+
+		transport, err := NewTransport(&TransportConfig{TLS: &TLSConfig{Insecure: true}, DisableHTTP2: disableHTTP2})
+		if err != nil {
+			t.Fatalf("NewTransport %s", err)
+		}
+		agents := []*Pubnub{
+			NewClient("pub", "sub", WithOrigin(srv.URL), WithTransport(transport)),
+			NewClient("pub", "sub", WithOrigin(srv.URL), WithTransport(transport)),
+		}
+
+		for i := 0; i < 10; i++ {
+			if _, _, err := agents[i%2].httpRequest(context.Background(), "/time/0", false); err != nil {
+				t.Fatalf("Request %s", err)
+			}
+		}
+
+		// One handshake for both agents
+		stats := transport.Stats()
+		if stats != (TransportStats{Requests: 10, Reused: 9, Created: 1, TLSHandshakes: 1}) {
+			t.Errorf("Unexpected stats %+v", stats)
+		}
+		if n := atomic.LoadInt64(&http2); (n == 10) == disableHTTP2 {
+			t.Errorf("Expected HTTP/2 %v got %d HTTP/2 requests", !disableHTTP2, n)
+		}
+
+		transport.CloseIdleConnections()
+		agents[0].httpRequest(context.Background(), "/time/0", false)
+		if stats := transport.Stats(); stats.Created != 2 {
+			t.Errorf("Expected a new connection after CloseIdleConnections got %+v", stats)
+		}
+	}
+}
+
+func TestNewTransportErrors(t *testing.T) {
+	if _, err := NewTransport(&TransportConfig{Proxy: &ProxyConfig{URL: "ftp://proxy"}}); err == nil {
+		t.Errorf("Expected invalid proxy error")
+	}
+	if _, err := NewTransport(&TransportConfig{TLS: &TLSConfig{CAFile: "/missing.pem"}}); err == nil {
+		t.Errorf("Expected missing CA file error")
+	}
+}
@@ -1,23 +1,27 @@
 package pubnub
 
 import (
+	"context"
+	"crypto/tls"
 	"net"
 	"net/http"
+	"net/url"
 	"sync"
+	"time"
 )
 
 type (
 	Pubnub struct {
-		origin       string
-		publishKey   string
-		subscribeKey string
-		secretKey    string
-		cipherKey    string
-		//isSSL              bool
+		origin             string
+		publishKey         string
+		subscribeKey       string
+		secretKey          string
+		cipherKey          string
+		isSSL              bool
 		uuid               string
 		subscribedChannels string
 		connectRetry       int
-		subscribeTimeout   int64
+		subscribeTimeout   time.Duration
 
 		subscribeChannels map[string]chan []byte
 		//subscribeErrorChannels map[string]chan []byte
@@ -29,17 +33,53 @@ type (
 		nonSubscribeTransport http.RoundTripper
 		nonSubscribeConn      net.Conn
 
-		client *http.Client
+		client       *http.Client
+		customClient bool // client set by WithHTTPClient
+		tlsConfig    *tls.Config
+		proxy        func(*http.Request) (*url.URL, error)
 
 		presenceChannels map[string]chan []byte
 		//presenceErrorChannels map[string]chan []byte
 
 		newSubscribedChannels string
-		connectTimeout        int64
-		nonSubscribeTimeout   int64
+		connectTimeout        time.Duration
+		nonSubscribeTimeout   time.Duration
+		logger                Logger
+		requestHook           RequestHook
+
+		clockSync      time.Duration // Clock offset refresh interval, 0 disables
+		clockThreshold time.Duration // Offset logged above
+		clockOffset    time.Duration // PubNub time - local time
+		clockSynced    time.Time
+		clockLock      sync.Mutex
+
 		sync.Mutex
 	}
 
+	// Option configures a Pubnub instance in NewClient and New
+	Option func(*Pubnub)
+
+	// RequestEvent is an HTTP request attempt, reported to the hook set by
+	// WithRequestHook.
+	RequestEvent struct {
+		Method   string
+		Endpoint string // Path without keys and arguments, eg. publish or v2/auth/grant
+		Status   int    // HTTP status, 0 when PubNub was not reached
+		Retry    int    // Timed out attempts before this one
+		Start    time.Time
+		End      time.Time
+		Err      error
+	}
+
+	// RequestHook receives the context of the call and each of its attempts.
+	RequestHook func(ctx context.Context, e *RequestEvent)
+
+	// Logger receives the library messages, *log.Logger satisfies it.
+	// Implement LevelLogger to receive debug messages and fields.
+	Logger interface {
+		Printf(format string, v ...interface{})
+	}
+
 	// Base response
 	Response struct {
 		Status  int    `json:"status"`
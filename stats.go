@@ -0,0 +1,297 @@
+package main
+
+import (
+	"errors"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"lib/net/http/pubnub"
+)
+
+// Operations counted by stats
+const (
+	opPublish    = "publish"
+	opGrant      = "grant"
+	opGrantToken = "grant_token"
+)
+
+// latencySamples is the number of recent deliveries used by percentiles
+const latencySamples = 1024
+
+type (
+	// stats are the worker counters reported by pubnub_status.
+	stats struct {
+		mu         sync.Mutex
+		ops        map[string]*opStats
+		lastError  string
+		lastErrorT time.Time
+		latencies  []time.Duration // Ring of the last deliveries
+		next       int
+
+		responses map[string]map[string]int64 // Attempts by operation and HTTP status
+		durations map[string]*histogram       // Delivery latency by operation
+		poolWait  *histogram                  // Wait for a pool agent
+
+		poolTimeouts  int64 // Acquires given up
+		poolDiscarded int64 // Agents replaced after failures
+
+		rateDelayed int64 // Messages held back by a rate limit
+		rateDropped int64 // Messages dropped by a rate limit
+	}
+
+	// histogram counts observations in cumulative buckets (Prometheus style).
+	histogram struct {
+		bounds    []float64 // Upper bounds in seconds
+		counts    []int64   // Observations <= bound, the last one is +Inf
+		sum       float64
+		exemplars []exemplar // Last observation of each bucket with an id
+	}
+
+	// exemplar links a bucket to the message id of an observation.
+	exemplar struct {
+		ID    string
+		Value float64
+		Time  time.Time
+	}
+
+	opStats struct {
+		Enqueued  int64 `json:"enqueued"`  // Accepted by the worker
+		Delivered int64 `json:"delivered"` // Sent to PubNub
+		Failed    int64 `json:"failed"`    // Given up after an error
+		Retried   int64 `json:"retried"`   // Attempts sent again
+		Dropped   int64 `json:"dropped"`   // Never sent, worker stopped or rate limited
+	}
+
+	// status is the pubnub_status document.
+	status struct {
+		Queue      int                    `json:"queue"`
+		Inflight   int64                  `json:"inflight"`
+		Pool       poolStatus             `json:"pool"`
+		Transport  *pubnub.TransportStats `json:"transport,omitempty"`
+		RateLimit  rateLimitStatus        `json:"rate_limit"`
+		Breaker    *breakerStatus         `json:"breaker,omitempty"`
+		Operations map[string]*opStats    `json:"operations"`
+		LastError  *lastError             `json:"last_error"`
+		LatencyMs  latency                `json:"latency_ms"`
+	}
+
+	poolStatus struct {
+		Size            int     `json:"size"`
+		InUse           int     `json:"in_use"`
+		Utilization     float64 `json:"utilization"`
+		AcquireTimeouts int64   `json:"acquire_timeouts"`
+		Discarded       int64   `json:"discarded"`
+	}
+
+	rateLimitStatus struct {
+		Delayed int64 `json:"delayed"`
+		Dropped int64 `json:"dropped"`
+	}
+
+	lastError struct {
+		Message string    `json:"message"`
+		Time    time.Time `json:"time"`
+	}
+
+	latency struct {
+		Samples int     `json:"samples"`
+		P50     float64 `json:"p50"`
+		P90     float64 `json:"p90"`
+		P99     float64 `json:"p99"`
+		Max     float64 `json:"max"`
+	}
+)
+
+func newStats() *stats {
+	s := &stats{
+		ops:       make(map[string]*opStats),
+		responses: make(map[string]map[string]int64),
+		durations: make(map[string]*histogram),
+		poolWait:  newHistogram(),
+	}
+	for _, op := range []string{opPublish, opGrant, opGrantToken} {
+		s.ops[op] = &opStats{}
+		s.responses[op] = make(map[string]int64)
+		s.durations[op] = newHistogram()
+	}
+	return s
+}
+
+// Latency buckets in seconds
+var histogramBounds = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+func newHistogram() *histogram {
+	return &histogram{
+		bounds:    histogramBounds,
+		counts:    make([]int64, len(histogramBounds)+1),
+		exemplars: make([]exemplar, len(histogramBounds)+1),
+	}
+}
+
+// observe counts d, id is kept as the exemplar of its bucket when set.
+func (h *histogram) observe(d time.Duration, id string) {
+	v := d.Seconds()
+	h.sum += v
+	bucket := len(h.bounds)
+	for i := len(h.bounds) - 1; i >= 0 && v <= h.bounds[i]; i-- {
+		h.counts[i]++
+		bucket = i
+	}
+	h.counts[len(h.bounds)]++
+
+	if id != "" {
+		h.exemplars[bucket] = exemplar{ID: id, Value: v, Time: time.Now()}
+	}
+}
+
+func (h *histogram) copy() *histogram {
+	c := *h
+	c.counts = append([]int64(nil), h.counts...)
+	c.exemplars = append([]exemplar(nil), h.exemplars...)
+	return &c
+}
+
+// count applies fn to the counters of op.
+func (s *stats) count(op string, fn func(*opStats)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	o, ok := s.ops[op]
+	if !ok {
+		o = &opStats{}
+		s.ops[op] = o
+	}
+	fn(o)
+}
+
+func (s *stats) Enqueued(op string) { s.count(op, func(o *opStats) { o.Enqueued++ }) }
+func (s *stats) Retried(op string)  { s.count(op, func(o *opStats) { o.Retried++ }) }
+func (s *stats) Dropped(op string)  { s.count(op, func(o *opStats) { o.Dropped++ }) }
+
+// Delivered records a successful delivery of message id and its latency.
+func (s *stats) Delivered(op string, d time.Duration, id string) {
+	s.count(op, func(o *opStats) { o.Delivered++ })
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	h, ok := s.durations[op]
+	if !ok {
+		h = newHistogram()
+		s.durations[op] = h
+	}
+	h.observe(d, id)
+
+	if len(s.latencies) < latencySamples {
+		s.latencies = append(s.latencies, d)
+		return
+	}
+	s.latencies[s.next] = d
+	s.next = (s.next + 1) % latencySamples
+}
+
+// Response counts an attempt by the HTTP status of its result, "error"
+// when PubNub was not reached.
+func (s *stats) Response(op string, err error) {
+	status := "200"
+	var apiErr *pubnub.APIError
+	if errors.As(err, &apiErr) {
+		status = strconv.Itoa(apiErr.Status)
+	} else if err != nil {
+		status = "error"
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.responses[op] == nil {
+		s.responses[op] = make(map[string]int64)
+	}
+	s.responses[op][status]++
+}
+
+// PoolWait records the wait for a pool agent.
+func (s *stats) PoolWait(d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.poolWait.observe(d, "")
+}
+
+// PoolTimeout counts an acquire given up without an agent.
+func (s *stats) PoolTimeout() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.poolTimeouts++
+}
+
+// AgentDiscarded counts an agent replaced after failures.
+func (s *stats) AgentDiscarded() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.poolDiscarded++
+}
+
+// RateDelayed counts a message held back by a rate limit.
+func (s *stats) RateDelayed() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.rateDelayed++
+}
+
+// RateDropped counts a message dropped by a rate limit.
+func (s *stats) RateDropped() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.rateDropped++
+}
+
+// Failed records a delivery given up after err, redacted as the logs.
+func (s *stats) Failed(op string, err error) {
+	s.count(op, func(o *opStats) { o.Failed++ })
+
+	message := logger.redact(err.Error())
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lastError = message
+	s.lastErrorT = time.Now()
+}
+
+// snapshot copies the counters and computes the latency percentiles.
+func (s *stats) snapshot() *status {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	st := &status{Operations: make(map[string]*opStats, len(s.ops))}
+	for op, o := range s.ops {
+		c := *o
+		st.Operations[op] = &c
+	}
+	st.Pool.AcquireTimeouts, st.Pool.Discarded = s.poolTimeouts, s.poolDiscarded
+	st.RateLimit.Delayed, st.RateLimit.Dropped = s.rateDelayed, s.rateDropped
+	if s.lastError != "" {
+		st.LastError = &lastError{Message: s.lastError, Time: s.lastErrorT}
+	}
+
+	sorted := append([]time.Duration(nil), s.latencies...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	st.LatencyMs = latency{
+		Samples: len(sorted),
+		P50:     percentile(sorted, 50),
+		P90:     percentile(sorted, 90),
+		P99:     percentile(sorted, 99),
+		Max:     percentile(sorted, 100),
+	}
+
+	return st
+}
+
+// percentile returns the p-th percentile in milliseconds (nearest rank).
+func percentile(sorted []time.Duration, p int) float64 {
+	if len(sorted) == 0 {
+		return 0
+	}
+	rank := (p*len(sorted) + 99) / 100
+	if rank < 1 {
+		rank = 1
+	}
+	return float64(sorted[rank-1]) / float64(time.Millisecond)
+}
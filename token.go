@@ -0,0 +1,66 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"lib/net/http/pubnub"
+)
+
+// tokenPermissions is the permissions argument of pubnub_grant_token,
+// rights are letters (rwmdguj) by resource name or pattern.
+type tokenPermissions struct {
+	Channels map[string]string `json:"channels"`
+	Groups   map[string]string `json:"groups"`
+	UUIDs    map[string]string `json:"uuids"`
+	Patterns struct {
+		Channels map[string]string `json:"channels"`
+		Groups   map[string]string `json:"groups"`
+		UUIDs    map[string]string `json:"uuids"`
+	} `json:"patterns"`
+	Meta map[string]interface{} `json:"meta"`
+}
+
+// tokenRequest builds a grant token request from the pubnub_grant_token arguments.
+func tokenRequest(ttl int, authorizedUUID string, permissions string) (*pubnub.TokenRequest, error) {
+	var p tokenPermissions
+	if err := json.Unmarshal([]byte(permissions), &p); err != nil {
+		return nil, err
+	}
+
+	req := &pubnub.TokenRequest{
+		TTL:            ttl,
+		AuthorizedUUID: authorizedUUID,
+		Meta:           p.Meta,
+	}
+
+	var err error
+	rights := func(resources map[string]string) map[string]pubnub.Permission {
+		if err != nil || len(resources) == 0 {
+			return nil
+		}
+		perms := make(map[string]pubnub.Permission, len(resources))
+		for name, letters := range resources {
+			perm, e := pubnub.ParsePermission(letters)
+			if e != nil {
+				err = fmt.Errorf("%s: %s", name, e)
+				return nil
+			}
+			perms[name] = perm
+		}
+		return perms
+	}
+
+	req.Resources = pubnub.TokenResources{
+		Channels: rights(p.Channels),
+		Groups:   rights(p.Groups),
+		UUIDs:    rights(p.UUIDs),
+	}
+	req.Patterns = pubnub.TokenResources{
+		Channels: rights(p.Patterns.Channels),
+		Groups:   rights(p.Patterns.Groups),
+		UUIDs:    rights(p.Patterns.UUIDs),
+	}
+
+	return req, err
+}
@@ -0,0 +1,392 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	mrand "math/rand"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"lib/net/http/pubnub"
+)
+
+// OTLP span kinds
+const (
+	spanKindInternal = 1
+	spanKindClient   = 3
+	spanKindProducer = 4
+	spanKindConsumer = 5
+)
+
+// OTLP status codes
+const (
+	spanStatusOK    = 1
+	spanStatusError = 2
+)
+
+const (
+	traceQueueSize = 4096            // Ended spans waiting for export, dropped above
+	traceBatchSize = 512             // Spans by export request
+	traceFlush     = 5 * time.Second // Max wait before an export
+	traceTimeout   = 5 * time.Second // Export request timeout
+	traceScope     = "pubnub_udf"    // Instrumentation scope
+)
+
+var errTraceparent = errors.New("invalid traceparent")
+
+type (
+	// spanContext identifies a span, propagated as a W3C traceparent.
+	spanContext struct {
+		TraceID [16]byte
+		SpanID  [8]byte
+		Sampled bool
+	}
+
+	// span is a timed operation of a trace, exported when sampled. The
+	// methods of a nil span do nothing, so callers need no tracer check.
+	span struct {
+		tracer     *tracer
+		name       string
+		kind       int
+		ctx        spanContext
+		parent     [8]byte // Zero for a root span
+		start      time.Time
+		end        time.Time
+		attributes []interface{} // Key and value pairs
+		status     int
+		message    string
+	}
+
+	// tracer creates spans and exports them in batches to an OTLP/HTTP
+	// collector, with the JSON encoding.
+	tracer struct {
+		endpoint string
+		service  string
+		ratio    float64 // Sampled root spans
+		client   *http.Client
+		queue    chan *span
+
+		mu      sync.Mutex
+		dropped int64 // Spans lost, queue full or export failed
+
+		ctx    context.Context
+		cancel context.CancelFunc
+		done   chan struct{}
+	}
+
+	// deliveryKey is the context key of the span of a delivery, the parent
+	// of its request spans.
+	deliveryKey struct{}
+
+	delivery struct {
+		span    *span
+		channel string
+		retries int // Attempts before this one
+	}
+)
+
+// newTracer creates a tracer exporting to the OTLP/HTTP traces url endpoint.
+func newTracer(endpoint, service string, ratio float64) (*tracer, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("unsupported trace endpoint %q", endpoint)
+	}
+
+	t := &tracer{
+		endpoint: endpoint,
+		service:  service,
+		ratio:    ratio,
+		client:   &http.Client{Timeout: traceTimeout},
+		queue:    make(chan *span, traceQueueSize),
+		done:     make(chan struct{}),
+	}
+	t.ctx, t.cancel = context.WithCancel(context.Background())
+	return t, nil
+}
+
+// parseTraceparent decodes a W3C traceparent header value.
+func parseTraceparent(s string) (spanContext, error) {
+	var c spanContext
+
+	parts := strings.Split(s, "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" ||
+		(parts[0] == "00" && len(parts) != 4) {
+		return c, errTraceparent
+	}
+	version, traceID, spanID, flags := parts[0], parts[1], parts[2], parts[3]
+	if len(traceID) != 32 || len(spanID) != 16 || len(flags) != 2 ||
+		strings.ToLower(s) != s {
+		return c, errTraceparent
+	}
+
+	if _, err := hex.Decode(c.TraceID[:], []byte(traceID)); err != nil {
+		return c, errTraceparent
+	}
+	if _, err := hex.Decode(c.SpanID[:], []byte(spanID)); err != nil {
+		return c, errTraceparent
+	}
+	f, err := strconv.ParseUint(version+flags, 16, 16)
+	if err != nil || !c.Valid() {
+		return c, errTraceparent
+	}
+	c.Sampled = f&1 == 1
+
+	return c, nil
+}
+
+// Valid is false for the zero context.
+func (c spanContext) Valid() bool {
+	return c.TraceID != [16]byte{} && c.SpanID != [8]byte{}
+}
+
+// StartSpan creates a span started at start, child of parent when valid.
+func (t *tracer) StartSpan(name string, kind int, parent spanContext, start time.Time) *span {
+	if t == nil {
+		return nil
+	}
+
+	s := &span{tracer: t, name: name, kind: kind, start: start}
+	if parent.Valid() {
+		s.ctx.TraceID = parent.TraceID
+		s.ctx.Sampled = parent.Sampled
+		s.parent = parent.SpanID
+	} else {
+		rand.Read(s.ctx.TraceID[:])
+		s.ctx.Sampled = mrand.Float64() < t.ratio
+	}
+	rand.Read(s.ctx.SpanID[:])
+
+	return s
+}
+
+// Context returns the context of children spans.
+func (s *span) Context() spanContext {
+	if s == nil {
+		return spanContext{}
+	}
+	return s.ctx
+}
+
+// SetAttributes adds key and value pairs, values are strings, integers,
+// floats or booleans.
+func (s *span) SetAttributes(kv ...interface{}) {
+	if s == nil {
+		return
+	}
+	s.attributes = append(s.attributes, kv...)
+}
+
+// SetStatus marks the span ok, or failed with err.
+func (s *span) SetStatus(err error) {
+	if s == nil {
+		return
+	}
+	if err != nil {
+		s.status, s.message = spanStatusError, logger.redact(err.Error())
+		return
+	}
+	s.status, s.message = spanStatusOK, ""
+}
+
+// End ends the span at end and queues it for export when sampled.
+func (s *span) End(end time.Time) {
+	if s == nil || !s.ctx.Sampled {
+		return
+	}
+	s.end = end
+
+	select {
+	case s.tracer.queue <- s:
+	default:
+		s.tracer.drop(1)
+	}
+}
+
+// withDelivery returns ctx carrying the delivery span for request spans.
+func withDelivery(ctx context.Context, s *span, channel string, retries int) context.Context {
+	if s == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, deliveryKey{}, &delivery{span: s, channel: channel, retries: retries})
+}
+
+// traceRequest is the pubnub request hook, it records a client span for
+// each request attempt of a traced delivery.
+func traceRequest(ctx context.Context, e *pubnub.RequestEvent) {
+	d, ok := ctx.Value(deliveryKey{}).(*delivery)
+	if !ok {
+		return
+	}
+
+	s := d.span.tracer.StartSpan(e.Method+" "+e.Endpoint, spanKindClient, d.span.Context(), e.Start)
+	s.SetAttributes(
+		"http.request.method", e.Method,
+		"pubnub.endpoint", e.Endpoint,
+		"pubnub.channel", d.channel,
+		"pubnub.retry_count", d.retries+e.Retry,
+	)
+	if e.Status != 0 {
+		s.SetAttributes("http.response.status_code", e.Status)
+	}
+
+	err := e.Err
+	if err == nil && e.Status >= 400 {
+		err = errors.New(http.StatusText(e.Status))
+	}
+	s.SetStatus(err)
+	s.End(e.End)
+}
+
+// Dropped returns the number of spans lost.
+func (t *tracer) Dropped() int64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.dropped
+}
+
+func (t *tracer) drop(n int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.dropped += int64(n)
+}
+
+// Start runs the export loop.
+func (t *tracer) Start() {
+	go func() {
+		defer close(t.done)
+
+		var spans []*span
+		ticker := time.NewTicker(traceFlush)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case s := <-t.queue:
+				spans = append(spans, s)
+				if len(spans) < traceBatchSize {
+					continue
+				}
+			case <-ticker.C:
+			case <-t.ctx.Done():
+				// Export the queued spans
+				for len(t.queue) > 0 {
+					spans = append(spans, <-t.queue)
+				}
+				for len(spans) > 0 {
+					n := len(spans)
+					if n > traceBatchSize {
+						n = traceBatchSize
+					}
+					t.export(spans[:n])
+					spans = spans[n:]
+				}
+				return
+			}
+
+			if len(spans) > 0 {
+				t.export(spans)
+				spans = nil
+			}
+		}
+	}()
+}
+
+// Stop exports the ended spans.
+func (t *tracer) Stop() {
+	t.cancel()
+	<-t.done
+}
+
+// export posts spans to the collector.
+func (t *tracer) export(spans []*span) {
+	body, err := json.Marshal(t.request(spans))
+	if err != nil {
+		logger.Error("Failed to encode spans", "error", err)
+		t.drop(len(spans))
+		return
+	}
+
+	resp, err := t.client.Post(t.endpoint, "application/json", bytes.NewReader(body))
+	if err != nil {
+		logger.Warn("Span export failed", "endpoint", t.endpoint, "error", err)
+		t.drop(len(spans))
+		return
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		logger.Warn("Span export refused", "endpoint", t.endpoint, "status", resp.StatusCode)
+		t.drop(len(spans))
+	}
+}
+
+// request builds the OTLP ExportTraceServiceRequest of spans.
+func (t *tracer) request(spans []*span) map[string]interface{} {
+	encoded := make([]map[string]interface{}, 0, len(spans))
+	for _, s := range spans {
+		e := map[string]interface{}{
+			"traceId":           hex.EncodeToString(s.ctx.TraceID[:]),
+			"spanId":            hex.EncodeToString(s.ctx.SpanID[:]),
+			"name":              s.name,
+			"kind":              s.kind,
+			"startTimeUnixNano": strconv.FormatInt(s.start.UnixNano(), 10),
+			"endTimeUnixNano":   strconv.FormatInt(s.end.UnixNano(), 10),
+			"attributes":        otlpAttributes(s.attributes),
+			"status":            map[string]interface{}{"code": s.status, "message": s.message},
+		}
+		if s.parent != [8]byte{} {
+			e["parentSpanId"] = hex.EncodeToString(s.parent[:])
+		}
+		encoded = append(encoded, e)
+	}
+
+	return map[string]interface{}{
+		"resourceSpans": []interface{}{
+			map[string]interface{}{
+				"resource": map[string]interface{}{
+					"attributes": otlpAttributes([]interface{}{"service.name", t.service}),
+				},
+				"scopeSpans": []interface{}{
+					map[string]interface{}{
+						"scope": map[string]interface{}{"name": traceScope},
+						"spans": encoded,
+					},
+				},
+			},
+		},
+	}
+}
+
+// otlpAttributes encodes key and value pairs as OTLP KeyValues.
+func otlpAttributes(kv []interface{}) []interface{} {
+	attributes := make([]interface{}, 0, len(kv)/2)
+	for i := 0; i+1 < len(kv); i += 2 {
+		var value map[string]interface{}
+		switch v := kv[i+1].(type) {
+		case int:
+			value = map[string]interface{}{"intValue": strconv.Itoa(v)}
+		case int64:
+			value = map[string]interface{}{"intValue": strconv.FormatInt(v, 10)}
+		case float64:
+			value = map[string]interface{}{"doubleValue": v}
+		case bool:
+			value = map[string]interface{}{"boolValue": v}
+		default:
+			value = map[string]interface{}{"stringValue": fmt.Sprint(v)}
+		}
+		attributes = append(attributes, map[string]interface{}{"key": fmt.Sprint(kv[i]), "value": value})
+	}
+	return attributes
+}
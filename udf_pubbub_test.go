@@ -1,7 +1,11 @@
 package main
 
 import (
+	"encoding/json"
+	"strings"
 	"testing"
+
+	"lib/net/http/pubnub"
 )
 
 func TestValidate(t *testing.T) {
@@ -24,3 +28,238 @@ func TestValidate(t *testing.T) {
 		}
 	}
 }
+
+func TestLimitSize(t *testing.T) {
+	defer func(c config) { *cfg = c }(*cfg)
+	cfg.MaxMessageSize = 32
+
+	small := []byte(`{"id":1}`)
+	large := []byte(`{"id":1,"body":"` + strings.Repeat("x", 64) + `"}`)
+
+	payload, err := limitSize("orders", small, nil)
+	if err != nil || string(payload) != string(small) {
+		t.Errorf("Unexpected result for small message %s : %v", payload, err)
+	}
+
+	cfg.OversizePolicy = oversizeReject
+	if _, err := limitSize("orders", large, []byte("1")); err != errTooLarge {
+		t.Errorf("Expected %v got %v", errTooLarge, err)
+	}
+
+	cfg.OversizePolicy = oversizeRef
+	payload, err = limitSize("orders", large, []byte("1"))
+	if err != nil || string(payload) != `{"ref":1}` {
+		t.Errorf("Unexpected ref message %s : %v", payload, err)
+	}
+
+	if _, err := limitSize("orders", large, nil); err != errTooLarge {
+		t.Errorf("Expected %v without ref got %v", errTooLarge, err)
+	}
+}
+
+func TestCheckMessage(t *testing.T) {
+	defer func(c config) { *cfg = c }(*cfg)
+
+	s, err := compileSchema([]byte(`{
+		"type": "object",
+		"required": ["id"],
+		"properties": {
+			"id": {"type": "integer", "minimum": 1},
+			"state": {"enum": ["new", "done"]}
+		}
+	}`))
+	if err != nil {
+		t.Fatalf("compileSchema %s", err)
+	}
+	cfg.schemas = map[string]*schema{"orders_": s}
+
+	tests := []struct {
+		channel, message string
+		strict, valid    bool
+	}{
+		{"counters_1", `42`, false, true},
+		{"counters_1", `"text"`, false, true},
+		{"counters_1", `[1,2]`, false, true},
+		{"counters_1", `42`, true, false},
+		{"counters_1", `{"n":42}`, true, true},
+		{"orders_1", `{"id":1,"state":"new"}`, false, true},
+		{"orders_1", `{"id":0}`, false, false},
+		{"orders_1", `{"id":1.5}`, false, false},
+		{"orders_1", `{"state":"new"}`, false, false},
+		{"orders_1", `{"id":1,"state":"lost"}`, false, false},
+	}
+
+	for _, test := range tests {
+		cfg.StrictObjects = test.strict
+		js, err := decodeJSON([]byte(test.message))
+		if err != nil {
+			t.Fatalf("decodeJSON %s : %s", test.message, err)
+		}
+		if err := checkMessage(test.channel, js); (err == nil) != test.valid {
+			t.Errorf("Unexpected result for %s on %s : %v", test.message, test.channel, err)
+		}
+	}
+
+	// INT, REAL and DECIMAL messages converted by MySQL
+	for _, message := range []string{`42`, `-1.50`, `1e+20`} {
+		if _, err := decodeJSON([]byte(message)); err != nil {
+			t.Errorf("decodeJSON %s : %s", message, err)
+		}
+	}
+
+	// NULL message
+	if _, err := decodeJSON(nil); err == nil {
+		t.Errorf("Expected error for a NULL message")
+	}
+
+	for _, message := range []string{`{} {}`, `{"a":1}}`, `[1]]`} {
+		if _, err := decodeJSON([]byte(message)); err == nil {
+			t.Errorf("Expected error for trailing data in %s", message)
+		}
+	}
+}
+
+func TestObject(t *testing.T) {
+	js := newObject()
+	js.Set("id", int64(1))
+	js.Set("name", "a \"quoted\" name")
+	js.Set("price", 9.5)
+	js.Set("deleted", nil)
+	js.Set("id", int64(2))
+
+	out, err := json.Marshal(js)
+	if err != nil {
+		t.Fatalf("Marshal %s", err)
+	}
+	expected := `{"id":2,"name":"a \"quoted\" name","price":9.5,"deleted":null}`
+	if string(out) != expected {
+		t.Errorf("Expected %s got %s", expected, out)
+	}
+}
+
+func TestRowKey(t *testing.T) {
+	defer func(c config) { *cfg = c }(*cfg)
+
+	cfg.RowKeyStrip = nil
+	if key := rowKey("NEW.id"); key != "NEW.id" {
+		t.Errorf("Expected NEW.id got %s", key)
+	}
+
+	cfg.RowKeyStrip = []string{"NEW.", "OLD."}
+	tests := map[string]string{
+		"NEW.id":    "id",
+		"OLD.state": "state",
+		"state":     "state",
+		"o.NEW.id":  "o.NEW.id",
+	}
+	for attribute, expected := range tests {
+		if key := rowKey(attribute); key != expected {
+			t.Errorf("Expected %s for %s got %s", expected, attribute, key)
+		}
+	}
+}
+
+func TestBatch(t *testing.T) {
+	rows := [][]byte{[]byte(`{"id":1}`), []byte(`{"id":2}`), []byte(`{"id":3}`), []byte(`"` + strings.Repeat("x", 64) + `"`)}
+
+	messages, dropped := batch("orders", rows, 1024)
+	if len(messages) != 1 || dropped != 0 {
+		t.Fatalf("Expected 1 message got %d, %d dropped", len(messages), dropped)
+	}
+	var js []interface{}
+	if err := json.Unmarshal(messages[0], &js); err != nil || len(js) != 4 {
+		t.Errorf("Unexpected message %s : %v", messages[0], err)
+	}
+
+	// Room for two small rows per message, the large one is dropped
+	max := pubnub.PublishSize("orders", `[{"id":1},{"id":2}]`)
+	messages, dropped = batch("orders", rows, max)
+	if dropped != 1 {
+		t.Errorf("Expected 1 dropped row got %d", dropped)
+	}
+	expected := []string{`[{"id":1},{"id":2}]`, `[{"id":3}]`}
+	if len(messages) != len(expected) {
+		t.Fatalf("Expected %d messages got %d", len(expected), len(messages))
+	}
+	for i, message := range messages {
+		if string(message) != expected[i] {
+			t.Errorf("Expected %s got %s", expected[i], message)
+		}
+		if size := pubnub.PublishSize("orders", string(message)); size > max {
+			t.Errorf("Message %s size %d exceeds %d", message, size, max)
+		}
+	}
+}
+
+func TestTokenRequest(t *testing.T) {
+	req, err := tokenRequest(60, "client-1", `{"channels":{"orders":"rw"},"uuids":{"client-1":"gu"},"patterns":{"channels":{"^orders-.*$":"r"}},"meta":{"user":"bob"}}`)
+	if err != nil {
+		t.Fatalf("tokenRequest %s", err)
+	}
+	if req.TTL != 60 || req.AuthorizedUUID != "client-1" || req.Meta["user"] != "bob" {
+		t.Errorf("Unexpected request %+v", req)
+	}
+	if req.Resources.Channels["orders"] != pubnub.PermRead|pubnub.PermWrite ||
+		req.Resources.UUIDs["client-1"] != pubnub.PermGet|pubnub.PermUpdate ||
+		req.Patterns.Channels["^orders-.*$"] != pubnub.PermRead {
+		t.Errorf("Unexpected permissions %+v %+v", req.Resources, req.Patterns)
+	}
+
+	for _, permissions := range []string{`{"channels":{"orders":"rx"}}`, `{"channels":`, `[]`} {
+		if _, err := tokenRequest(60, "", permissions); err == nil {
+			t.Errorf("Expected error for %s", permissions)
+		}
+	}
+}
+
+func TestLoggerRedaction(t *testing.T) {
+	var out strings.Builder
+	l := newLogger(&config{SecretKey: "my-secret", LogLevel: "info", LogFormat: logLogfmt})
+	l.out = &out
+
+	l.Warn("Publish failed",
+		"channel", "orders",
+		"error", `Get "https://ps.pndsn.com/publish?auth=key1&signature=v2.abc&uuid=u": timeout`,
+		"auth", "key1",
+		"payload", `{"card":"4111"}`,
+		"detail", `{"token":"p0abc","secret_key":"sec-c-123"} my-secret`,
+	)
+	l.Debug("Hidden")
+
+	line := out.String()
+	for _, leak := range []string{"key1", "v2.abc", "4111", "p0abc", "sec-c-123", "my-secret", "Hidden"} {
+		if strings.Contains(line, leak) {
+			t.Errorf("Unexpected %q in %s", leak, line)
+		}
+	}
+	for _, expected := range []string{"level=warn", `msg="Publish failed"`, "channel=orders", "auth=[REDACTED]", "uuid=u"} {
+		if !strings.Contains(line, expected) {
+			t.Errorf("Expected %q in %s", expected, line)
+		}
+	}
+}
+
+func TestLoggerFormats(t *testing.T) {
+	var out strings.Builder
+	l := newLogger(&config{LogLevel: "debug", LogFormat: logJSON})
+	l.out = &out
+
+	l.Debug("Publish dropped", "channel", "orders", "payload", `{"id":1}`, "msg", "field")
+
+	var line map[string]string
+	if err := json.Unmarshal([]byte(out.String()), &line); err != nil {
+		t.Fatalf("Invalid json line %s : %s", out.String(), err)
+	}
+	if line["level"] != "debug" || line["msg"] != "Publish dropped" || line["channel"] != "orders" ||
+		line["payload"] != `{"id":1}` || line["field.msg"] != "field" || line["time"] == "" {
+		t.Errorf("Unexpected line %v", line)
+	}
+
+	out.Reset()
+	l = newLogger(&config{})
+	l.out = &out
+	l.Printf("Clock drift %s", "12s")
+	if !strings.HasSuffix(out.String(), " INFO Clock drift 12s\n") {
+		t.Errorf("Unexpected text line %q", out.String())
+	}
+}
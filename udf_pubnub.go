@@ -3,6 +3,8 @@ package main
 /*
 #cgo CFLAGS: -I/usr/include/mysql -DMYSQL_DYNAMIC_PLUGIN -DMYSQL_ABI_CHECK
 #include <stdio.h>
+#include <stdint.h>
+#include <stdlib.h>
 #include <mysql.h>
 #include <string.h>
 
@@ -14,6 +16,48 @@ static int is_arg_string(UDF_ARGS *args,int arg_num) {
 	return 0;
 }
 
+static int is_arg_null(UDF_ARGS *args,int arg_num) {
+	if (args->arg_count > arg_num &&
+		args->args[arg_num] == NULL) {
+		return 1;
+	}
+	return 0;
+}
+
+static int get_arg_type(UDF_ARGS *args,int arg_num) {
+	if (args->arg_count > arg_num) {
+		return args->arg_type[arg_num];
+	}
+	return STRING_RESULT;
+}
+
+static void set_arg_string(UDF_ARGS *args,int arg_num) {
+	if (args->arg_count > arg_num) {
+		args->arg_type[arg_num] = STRING_RESULT;
+	}
+}
+
+static unsigned long get_string_len(UDF_ARGS *args, int arg_num) {
+	if (args->arg_count > arg_num) {
+		return args->lengths[arg_num];
+	}
+	return 0;
+}
+
+static char* get_attribute(UDF_ARGS *args, int arg_num) {
+	if (args->arg_count > arg_num) {
+		return args->attributes[arg_num];
+	}
+	return NULL;
+}
+
+static unsigned long get_attribute_len(UDF_ARGS *args, int arg_num) {
+	if (args->arg_count > arg_num) {
+		return args->attribute_lengths[arg_num];
+	}
+	return 0;
+}
+
 static char* get_string_val(UDF_ARGS *args, int arg_num) {
 	if (args->arg_count > arg_num) {
 		return args->args[arg_num];
@@ -28,14 +72,50 @@ static long long get_int_val(UDF_ARGS *args, int arg_num) {
 	return int_val;
 }
 
+static double get_real_val(UDF_ARGS *args, int arg_num) {
+	double real_val;
+	if (args->arg_count > arg_num) {
+		real_val = *((double*) args->args[arg_num]);
+	}
+	return real_val;
+}
+
+static void set_handle(UDF_INIT *initid, uintptr_t handle) {
+	uintptr_t *ptr = malloc(sizeof(uintptr_t));
+	*ptr = handle;
+	initid->ptr = (char*) ptr;
+}
+
+static uintptr_t get_handle(UDF_INIT *initid) {
+	return *((uintptr_t*) initid->ptr);
+}
+
+static void free_handle(UDF_INIT *initid) {
+	free(initid->ptr);
+	initid->ptr = NULL;
+}
+
+static char* set_result(UDF_INIT *initid, char *value, unsigned long len) {
+	free(initid->ptr);
+	initid->ptr = malloc(len);
+	memcpy(initid->ptr, value, len);
+	return initid->ptr;
+}
+
 */
 import "C"
 
 import (
 	"encoding/json"
-	"log"
+	"errors"
+	"fmt"
+	"runtime/cgo"
 	"strconv"
 	"strings"
+	"time"
+	"unsafe"
+
+	"lib/net/http/pubnub"
 )
 
 var w *worker
@@ -46,19 +126,48 @@ const (
 	secKey = "sec-c-XXXXXXXXXXXXXXXXXXXXXXXXXXXXXXXXXXXXXXXXXXXXXXXX"
 )
 
+// pubnub_publish results
+const (
+	publishOK       = 0 // Message queued
+	publishInvalid  = 1 // Invalid channel or message
+	publishTooLarge = 2 // Message exceeds max_message_size
+	publishPaused   = 3 // Circuit breaker open with breaker_fail_fast, or invalid transport settings
+)
+
+// grantTokenTimeout limits the wait of pubnub_grant_token for PubNub
+const grantTokenTimeout = 10 * time.Second
+
+// maxPoolSize is the largest size accepted by pubnub_pool_resize
+const maxPoolSize = 1000
+
+// blobLength is the result length declared to MySQL for JSON and token
+// results
+const blobLength = 65535
+
+var errTooLarge = errors.New("message too large")
+
 type (
 	publishMessage struct {
-		Channel string // Channel
-		Store   bool   // Store in history
-		Online  bool   // Send only if active grants on chan
-		Message []byte // Json message
+		ID       string      // Correlation id
+		Channel  string      // Channel
+		Store    bool        // Store in history
+		Online   bool        // Send only if active grants on chan
+		Message  []byte      // Json message
+		Meta     string      // Json meta, empty when not sent
+		Enqueued time.Time   // Queued at
+		Trace    spanContext // Enqueue span
+		Delayed  bool        // Held back by a rate limit
 	}
 
 	grantMessage struct {
-		Channel              string // Channel
-		Auth                 string // Auth key
-		Read, Write, Manager bool   // Rights
-		Ttl                  int    // TTL
+		ID                   string      // Correlation id
+		Channel              string      // Channel
+		Auth                 string      // Auth key
+		Read, Write, Manager bool        // Rights
+		Ttl                  int         // TTL
+		Enqueued             time.Time   // Queued at
+		Trace                spanContext // Enqueue span
+		Delayed              bool        // Held back by a rate limit
 	}
 )
 
@@ -112,7 +221,7 @@ func pubnub_grant(
 
 	channel, v := validate(chann)
 	if !v {
-		log.Printf("Invalid channel name %q for grant %q !", chann, channel)
+		logger.Warn("Invalid channel name for grant", "channel", chann, "normalized", channel)
 		return 1
 	}
 
@@ -127,6 +236,168 @@ func pubnub_grant(
 	return 0
 }
 
+//export pubnub_grant_token_init
+func pubnub_grant_token_init(
+	initid *C.UDF_INIT,
+	args *C.UDF_ARGS,
+	message *C.char,
+) C.my_bool {
+
+	if args.arg_count != 3 {
+		C.strcpy(message, C.CString("pubnub_grant_token(ttl int, authorized_uuid string, permissions json). \n"))
+		return 1
+	}
+
+	// ttl and authorized uuid are converted by MySQL
+	C.set_arg_string(args, 0)
+	C.set_arg_string(args, 1)
+
+	if C.is_arg_string(args, 2) == 0 {
+		C.strcpy(message, C.CString("permissions param is not string\n"))
+		return 1
+	}
+
+	initid.max_length = blobLength
+	initid.maybe_null = 1
+	initid.ptr = nil
+	return 0
+}
+
+//export pubnub_grant_token_deinit
+func pubnub_grant_token_deinit(initid *C.UDF_INIT) {
+	C.free(unsafe.Pointer(initid.ptr))
+	initid.ptr = nil
+}
+
+//export pubnub_grant_token
+func pubnub_grant_token(
+	initid *C.UDF_INIT,
+	args *C.UDF_ARGS,
+	result *C.char,
+	length *C.ulong,
+	is_null *C.char,
+	error *C.char,
+) *C.char {
+
+	ttl, err := strconv.Atoi(strings.TrimSpace(argString(args, 0)))
+	if err != nil {
+		logger.Warn("Invalid ttl for grant token", "error", err)
+		*is_null = 1
+		return nil
+	}
+
+	authorizedUUID := ""
+	if C.is_arg_null(args, 1) == 0 {
+		authorizedUUID = argString(args, 1)
+	}
+
+	req, err := tokenRequest(ttl, authorizedUUID, argString(args, 2))
+	if err != nil {
+		logger.Warn("Invalid permissions for grant token", "error", err)
+		*is_null = 1
+		return nil
+	}
+
+	token, err := w.GrantToken(req, grantTokenTimeout)
+	if err != nil {
+		logger.Error("Grant token failed", "error", err)
+		*is_null = 1
+		return nil
+	}
+
+	value := C.CString(token)
+	defer C.free(unsafe.Pointer(value))
+
+	*length = C.ulong(len(token))
+	return C.set_result(initid, value, C.ulong(len(token)))
+}
+
+//export pubnub_status_init
+func pubnub_status_init(
+	initid *C.UDF_INIT,
+	args *C.UDF_ARGS,
+	message *C.char,
+) C.my_bool {
+
+	if args.arg_count != 0 {
+		C.strcpy(message, C.CString("pubnub_status(). \n"))
+		return 1
+	}
+
+	initid.max_length = blobLength
+	initid.ptr = nil
+	return 0
+}
+
+//export pubnub_status_deinit
+func pubnub_status_deinit(initid *C.UDF_INIT) {
+	C.free(unsafe.Pointer(initid.ptr))
+	initid.ptr = nil
+}
+
+//export pubnub_status
+func pubnub_status(
+	initid *C.UDF_INIT,
+	args *C.UDF_ARGS,
+	result *C.char,
+	length *C.ulong,
+	is_null *C.char,
+	error *C.char,
+) *C.char {
+
+	status, err := json.Marshal(w.Status())
+	if err != nil {
+		*error = 1
+		return nil
+	}
+
+	value := C.CString(string(status))
+	defer C.free(unsafe.Pointer(value))
+
+	*length = C.ulong(len(status))
+	return C.set_result(initid, value, C.ulong(len(status)))
+}
+
+//export pubnub_pool_resize_init
+func pubnub_pool_resize_init(
+	initid *C.UDF_INIT,
+	args *C.UDF_ARGS,
+	message *C.char,
+) C.my_bool {
+
+	if args.arg_count != 1 {
+		C.strcpy(message, C.CString("pubnub_pool_resize(size int). \n"))
+		return 1
+	}
+
+	// size is converted by MySQL
+	C.set_arg_string(args, 0)
+
+	initid.maybe_null = 1
+	return 0
+}
+
+//export pubnub_pool_resize
+func pubnub_pool_resize(
+	initid *C.UDF_INIT,
+	args *C.UDF_ARGS,
+	result *C.char,
+	length *C.ulong,
+	is_null *C.char,
+	error *C.char,
+) C.longlong {
+
+	size, err := strconv.Atoi(strings.TrimSpace(argString(args, 0)))
+	if err != nil || size < 1 || size > maxPoolSize {
+		logger.Warn("Invalid pool size", "size", argString(args, 0), "max", maxPoolSize)
+		*is_null = 1
+		return 0
+	}
+
+	w.Resize(size)
+	return C.longlong(size)
+}
+
 //export pubnub_publish_init
 func pubnub_publish_init(
 	initid *C.UDF_INIT,
@@ -134,8 +405,8 @@ func pubnub_publish_init(
 	message *C.char,
 ) C.my_bool {
 
-	if args.arg_count < 2 {
-		C.strcpy(message, C.CString("pubnub_publish(channel string, message string, [flags string]). \n"))
+	if args.arg_count < 2 || args.arg_count > 5 {
+		C.strcpy(message, C.CString("pubnub_publish(channel string, message string, [flags string, [ref, [traceparent string]]]). \n"))
 		return 1
 	}
 
@@ -144,10 +415,12 @@ func pubnub_publish_init(
 		return 1
 	}
 
-	if C.is_arg_string(args, 1) == 0 {
-		C.strcpy(message, C.CString("message param is not string\n"))
-		return 1
-	}
+	// Numbers are converted by MySQL into valid json, NULL is refused by
+	// enqueue
+	C.set_arg_string(args, 1)
+
+	// traceparent is converted by MySQL
+	C.set_arg_string(args, 4)
 
 	return 0
 }
@@ -164,30 +437,378 @@ func pubnub_publish(
 
 	chann, message, flags :=
 		C.GoString(C.get_string_val(args, 0)),
-		C.GoString(C.get_string_val(args, 1)),
+		argString(args, 1),
 		""
 
 	if args.arg_count > 2 {
 		flags = C.GoString(C.get_string_val(args, 2))
 	}
 
-	payload := []byte(message)
-	var js map[string]interface{}
-	if err := json.Unmarshal(payload, &js); err != nil {
-		log.Printf("Failed to decode json %q : %s", payload, err)
+	traceparent := ""
+	if args.arg_count > 4 {
+		traceparent = argString(args, 4)
+	}
+
+	_, code := enqueue(chann, []byte(message), flags, refVal(args, 3), traceparent)
+	return code
+}
+
+//export pubnub_publish_id_init
+func pubnub_publish_id_init(
+	initid *C.UDF_INIT,
+	args *C.UDF_ARGS,
+	message *C.char,
+) C.my_bool {
+
+	if args.arg_count < 2 || args.arg_count > 5 {
+		C.strcpy(message, C.CString("pubnub_publish_id(channel string, message string, [flags string, [ref, [traceparent string]]]). \n"))
+		return 1
+	}
+
+	if C.is_arg_string(args, 0) == 0 {
+		C.strcpy(message, C.CString("channel param is not string\n"))
 		return 1
 	}
 
+	// Numbers are converted by MySQL into valid json, NULL is refused by
+	// enqueue
+	C.set_arg_string(args, 1)
+
+	// traceparent is converted by MySQL
+	C.set_arg_string(args, 4)
+
+	initid.max_length = ulidLength
+	initid.maybe_null = 1
+	initid.ptr = nil
+	return 0
+}
+
+//export pubnub_publish_id_deinit
+func pubnub_publish_id_deinit(initid *C.UDF_INIT) {
+	C.free(unsafe.Pointer(initid.ptr))
+	initid.ptr = nil
+}
+
+//export pubnub_publish_id
+func pubnub_publish_id(
+	initid *C.UDF_INIT,
+	args *C.UDF_ARGS,
+	result *C.char,
+	length *C.ulong,
+	is_null *C.char,
+	error *C.char,
+) *C.char {
+
+	flags, traceparent := "", ""
+	if args.arg_count > 2 {
+		flags = argString(args, 2)
+	}
+	if args.arg_count > 4 {
+		traceparent = argString(args, 4)
+	}
+
+	// NULL when the message is rejected, the reason is logged
+	id, _ := enqueue(argString(args, 0), []byte(argString(args, 1)), flags, refVal(args, 3), traceparent)
+	if id == "" {
+		*is_null = 1
+		return nil
+	}
+
+	value := C.CString(id)
+	defer C.free(unsafe.Pointer(value))
+
+	*length = C.ulong(len(id))
+	return C.set_result(initid, value, C.ulong(len(id)))
+}
+
+//export pubnub_publish_kv_init
+func pubnub_publish_kv_init(
+	initid *C.UDF_INIT,
+	args *C.UDF_ARGS,
+	message *C.char,
+) C.my_bool {
+
+	if args.arg_count < 3 || args.arg_count%2 == 0 {
+		C.strcpy(message, C.CString("pubnub_publish_kv(channel string, key1 string, val1, [key2 string, val2, ...]). \n"))
+		return 1
+	}
+
+	if C.is_arg_string(args, 0) == 0 {
+		C.strcpy(message, C.CString("channel param is not string\n"))
+		return 1
+	}
+
+	// Let MySQL convert keys to strings
+	for i := C.int(1); i < C.int(args.arg_count); i += 2 {
+		C.set_arg_string(args, i)
+	}
+
+	return 0
+}
+
+//export pubnub_publish_kv
+func pubnub_publish_kv(
+	initid *C.UDF_INIT,
+	args *C.UDF_ARGS,
+	result *C.char,
+	length *C.ulong,
+	is_null *C.char,
+	error *C.char,
+) C.longlong {
+
+	chann := C.GoString(C.get_string_val(args, 0))
+
+	js := newObject()
+	for i := C.int(1); i < C.int(args.arg_count); i += 2 {
+		js.Set(argString(args, i), argValue(args, i+1))
+	}
+
+	payload, err := json.Marshal(js)
+	if err != nil {
+		logger.Warn("Failed to encode json", "channel", chann, "error", err)
+		return publishInvalid
+	}
+
+	return publish(chann, payload, "", nil)
+}
+
+//export pubnub_publish_row_init
+func pubnub_publish_row_init(
+	initid *C.UDF_INIT,
+	args *C.UDF_ARGS,
+	message *C.char,
+) C.my_bool {
+
+	if args.arg_count < 2 {
+		C.strcpy(message, C.CString("pubnub_publish_row(channel string, col1, [col2 AS alias, ...]). \n"))
+		return 1
+	}
+
+	if C.is_arg_string(args, 0) == 0 {
+		C.strcpy(message, C.CString("channel param is not string\n"))
+		return 1
+	}
+
+	return 0
+}
+
+//export pubnub_publish_row
+func pubnub_publish_row(
+	initid *C.UDF_INIT,
+	args *C.UDF_ARGS,
+	result *C.char,
+	length *C.ulong,
+	is_null *C.char,
+	error *C.char,
+) C.longlong {
+
+	chann := C.GoString(C.get_string_val(args, 0))
+
+	js := newObject()
+	for i := C.int(1); i < C.int(args.arg_count); i++ {
+		attribute := C.GoStringN(C.get_attribute(args, i), C.int(C.get_attribute_len(args, i)))
+		js.Set(rowKey(attribute), argValue(args, i))
+	}
+
+	payload, err := json.Marshal(js)
+	if err != nil {
+		logger.Warn("Failed to encode json", "channel", chann, "error", err)
+		return publishInvalid
+	}
+
+	return publish(chann, payload, "", nil)
+}
+
+//export pubnub_publish_agg_init
+func pubnub_publish_agg_init(
+	initid *C.UDF_INIT,
+	args *C.UDF_ARGS,
+	message *C.char,
+) C.my_bool {
+
+	if args.arg_count < 2 || args.arg_count > 3 {
+		C.strcpy(message, C.CString("pubnub_publish_agg(channel string, message string, [flags string]). \n"))
+		return 1
+	}
+
+	if C.is_arg_string(args, 0) == 0 {
+		C.strcpy(message, C.CString("channel param is not string\n"))
+		return 1
+	}
+
+	if C.is_arg_string(args, 1) == 0 {
+		C.strcpy(message, C.CString("message param is not string\n"))
+		return 1
+	}
+
+	C.set_handle(initid, C.uintptr_t(cgo.NewHandle(newAggregate())))
+	return 0
+}
+
+//export pubnub_publish_agg_deinit
+func pubnub_publish_agg_deinit(initid *C.UDF_INIT) {
+	if initid.ptr == nil {
+		return
+	}
+	cgo.Handle(C.get_handle(initid)).Delete()
+	C.free_handle(initid)
+}
+
+//export pubnub_publish_agg_clear
+func pubnub_publish_agg_clear(
+	initid *C.UDF_INIT,
+	is_null *C.char,
+	error *C.char,
+) {
+	cgo.Handle(C.get_handle(initid)).Value().(*aggregate).Clear()
+}
+
+//export pubnub_publish_agg_add
+func pubnub_publish_agg_add(
+	initid *C.UDF_INIT,
+	args *C.UDF_ARGS,
+	is_null *C.char,
+	error *C.char,
+) {
+	flags := ""
+	if args.arg_count > 2 {
+		flags = argString(args, 2)
+	}
+
+	cgo.Handle(C.get_handle(initid)).Value().(*aggregate).Add(argString(args, 0), []byte(argString(args, 1)), flags)
+}
+
+//export pubnub_publish_agg
+func pubnub_publish_agg(
+	initid *C.UDF_INIT,
+	args *C.UDF_ARGS,
+	is_null *C.char,
+	error *C.char,
+) C.longlong {
+	return C.longlong(cgo.Handle(C.get_handle(initid)).Value().(*aggregate).Publish())
+}
+
+// rowKey strips the first matching row_key_strip prefix from an attribute name.
+func rowKey(attribute string) string {
+	for _, prefix := range cfg.RowKeyStrip {
+		if strings.HasPrefix(attribute, prefix) {
+			return attribute[len(prefix):]
+		}
+	}
+	return attribute
+}
+
+// publish validates and queues a message for pubnub_publish and its variants.
+func publish(chann string, payload []byte, flags string, ref []byte) C.longlong {
+	_, result := enqueue(chann, payload, flags, ref, "")
+	return result
+}
+
+// enqueue validates and queues a message, it returns the correlation id of
+// the queued message and the pubnub_publish result. traceparent links the
+// delivery spans to the trace of the caller.
+func enqueue(chann string, payload []byte, flags string, ref []byte, traceparent string) (string, C.longlong) {
+	js, err := decodeJSON(payload)
+	if err != nil {
+		logger.Warn("Failed to decode json", "error", err, "payload", string(payload))
+		return "", publishInvalid
+	}
+
 	// Avoid putting in queue messages with invalid payload
 	channel, v := validate(chann)
 	if !v {
-		log.Printf("Invalid channel name %q for publish %q!", chann, channel)
-		return 1
+		logger.Warn("Invalid channel name for publish", "channel", chann, "normalized", channel)
+		return "", publishInvalid
 	}
 
-	w.Publish(channel, payload, flags)
-	return 0
+	if err := checkMessage(channel, js); err != nil {
+		logger.Warn("Invalid message", "channel", channel, "error", err)
+		return "", publishInvalid
+	}
+
+	payload, err = limitSize(channel, payload, ref)
+	if err != nil {
+		logger.Warn("Publish rejected", "channel", channel, "error", err)
+		return "", publishTooLarge
+	}
+
+	// Never delivered, the settings error was logged at init
+	if w.unusable != nil {
+		return "", publishPaused
+	}
+
+	if cfg.BreakerFailFast && w.breaker.Open() {
+		w.breaker.Reject()
+		logger.Debug("Publish refused, circuit breaker open", "channel", channel)
+		return "", publishPaused
+	}
+
+	return w.PublishTraced(channel, payload, flags, traceparent), publishOK
+}
+
+// checkMessage applies strict_objects and the channel schema to a decoded message.
+func checkMessage(channel string, js interface{}) error {
+	if _, ok := js.(map[string]interface{}); cfg.StrictObjects && !ok {
+		return fmt.Errorf("expected json object got %s", typeOf(js))
+	}
+	if s := cfg.schemaFor(channel); s != nil {
+		return s.Validate(js)
+	}
+	return nil
+}
+
+// refVal returns the json encoded ref argument or nil when missing.
+func refVal(args *C.UDF_ARGS, arg_num C.int) []byte {
+	if C.int(args.arg_count) <= arg_num || C.is_arg_null(args, arg_num) == 1 {
+		return nil
+	}
+	ref, err := json.Marshal(argValue(args, arg_num))
+	if err != nil {
+		return nil
+	}
+	return ref
+}
+
+// argString returns a string argument using its length, as MySQL
+// does not guarantee string arguments to be null terminated.
+func argString(args *C.UDF_ARGS, arg_num C.int) string {
+	if C.is_arg_null(args, arg_num) == 1 {
+		return ""
+	}
+	return C.GoStringN(C.get_string_val(args, arg_num), C.int(C.get_string_len(args, arg_num)))
+}
+
+// argValue converts an argument to its json value according to its type.
+func argValue(args *C.UDF_ARGS, arg_num C.int) interface{} {
+	if C.is_arg_null(args, arg_num) == 1 {
+		return nil
+	}
+	switch C.get_arg_type(args, arg_num) {
+	case C.INT_RESULT:
+		return int64(C.get_int_val(args, arg_num))
+	case C.REAL_RESULT:
+		return float64(C.get_real_val(args, arg_num))
+	case C.DECIMAL_RESULT:
+		return json.Number(argString(args, arg_num))
+	}
+	return argString(args, arg_num)
+}
+
+// limitSize applies the oversize policy to messages larger than max_message_size.
+// The "ref" policy replaces the message with {"ref": ref} so clients can fetch it themselves.
+func limitSize(channel string, payload []byte, ref []byte) ([]byte, error) {
+	if pubnub.PublishSize(channel, string(payload)) <= cfg.MaxMessageSize {
+		return payload, nil
+	}
+
+	if cfg.OversizePolicy == oversizeRef && ref != nil {
+		payload = []byte(`{"ref":` + string(ref) + `}`)
+		if pubnub.PublishSize(channel, string(payload)) <= cfg.MaxMessageSize {
+			return payload, nil
+		}
+	}
 
+	return nil, errTooLarge
 }
 
 func validate(channel string) (string, bool) {
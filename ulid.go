@@ -0,0 +1,74 @@
+package main
+
+import (
+	"crypto/rand"
+	"sync"
+	"time"
+)
+
+// Crockford base32 alphabet of ULIDs
+const ulidAlphabet = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+// ulidLength is the number of characters of a ULID
+const ulidLength = 26
+
+// ulidGenerator returns monotonic ULIDs: ids created in the same
+// millisecond increment the random part of the previous one, so ids sort
+// in queue order.
+type ulidGenerator struct {
+	mu      sync.Mutex
+	lastMs  uint64
+	entropy [10]byte
+}
+
+var messageIDs ulidGenerator
+
+// newMessageID returns the correlation id of a queued message.
+func newMessageID() string {
+	return messageIDs.New(time.Now())
+}
+
+// New returns the ULID of t.
+func (g *ulidGenerator) New(t time.Time) string {
+	ms := uint64(t.UnixNano() / int64(time.Millisecond))
+
+	g.mu.Lock()
+	if ms > g.lastMs {
+		g.lastMs = ms
+		rand.Read(g.entropy[:])
+	} else {
+		// Same millisecond or clock going back: keep ordering
+		for i := len(g.entropy) - 1; i >= 0; i-- {
+			g.entropy[i]++
+			if g.entropy[i] != 0 {
+				break
+			}
+		}
+		ms = g.lastMs
+	}
+	var id [16]byte
+	for i := 0; i < 6; i++ {
+		id[i] = byte(ms >> (40 - 8*uint(i)))
+	}
+	copy(id[6:], g.entropy[:])
+	g.mu.Unlock()
+
+	return encodeULID(id)
+}
+
+// encodeULID writes the 128 bits of id as 26 base32 characters, the first
+// one holding the 3 leading bits.
+func encodeULID(id [16]byte) string {
+	var out [ulidLength]byte
+	hi := uint64(id[0])<<56 | uint64(id[1])<<48 | uint64(id[2])<<40 | uint64(id[3])<<32 |
+		uint64(id[4])<<24 | uint64(id[5])<<16 | uint64(id[6])<<8 | uint64(id[7])
+	lo := uint64(id[8])<<56 | uint64(id[9])<<48 | uint64(id[10])<<40 | uint64(id[11])<<32 |
+		uint64(id[12])<<24 | uint64(id[13])<<16 | uint64(id[14])<<8 | uint64(id[15])
+
+	for i := 25; i >= 0; i-- {
+		out[i] = ulidAlphabet[lo&0x1f]
+		lo = lo>>5 | hi<<59
+		hi >>= 5
+	}
+	return string(out[:])
+}
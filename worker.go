@@ -3,65 +3,388 @@ package main
 // Go imports
 import (
 	"container/list"
-	"log"
+	"context"
+	"errors"
+	"math/rand"
+	"net/http"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"lib/net/http/pubnub"
 )
 
 type worker struct {
-	connPool *pool      // Pool of PubnubAgents
-	queue    *list.List // Messages to Publish
-	qlock    sync.Mutex // Publish lock
+	connPool *pool[*pubnub.Pubnub] // Pool of PubnubAgents
+	queue    *list.List            // Messages to Publish
+	qlock    sync.Mutex            // Publish lock
+	starved  time.Time             // Since dispatch found no free agent, zero when one was left
+
+	ctx      context.Context    // Cancelled by Stop
+	cancel   context.CancelFunc // Stop deliveries
+	inflight sync.WaitGroup     // Running deliveries
+	active   int64              // Running deliveries, read by Status
+
+	stats     *stats            // Counters reported by pubnub_status
+	metrics   *http.Server      // Prometheus listener, nil when disabled
+	sink      *outcomeSink      // Delivery outcomes table, nil when disabled
+	tracer    *tracer           // OTLP spans, nil when disabled
+	transport *pubnub.Transport // Connections shared by the agents, nil when unknown
+	limiter   *rateLimiter      // Delivery rate limits, nil when unlimited
+	breaker   *breaker          // Pauses deliveries while PubNub fails, nil when disabled
+	unusable  error             // Invalid transport settings, no agent can be created
 }
 
 func init() {
-	w = &worker{
-		connPool: &pool{},
-		queue:    list.New(),
+	// The agents share one connection pool
+	var transport *pubnub.Transport
+	transportConfig, transportErr := cfg.transport()
+	if transportErr == nil {
+		transport, transportErr = pubnub.NewTransport(transportConfig)
+	}
+	if transportErr != nil {
+		// Agents fail to be created rather than ignore TLS or proxy settings
+		logger.Error("Invalid HTTP transport configuration", "error", transportErr)
+	}
+	if cfg.TLSInsecure {
+		logger.Warn("TLS certificate verification is disabled!")
 	}
 
 	// Initialize Pubnub Agent pool
-	w.connPool.InitPool(30,
-		func() (interface{}, error) {
-			return pubnub.New(pubKey, subKey, secKey, "", true, ""), nil
+	var err error
+	w, err = newWorker(cfg.PoolSize,
+		func() (*pubnub.Pubnub, error) {
+			if transportErr != nil {
+				return nil, transportErr
+			}
+			return pubnub.NewClient(cfg.PublishKey, cfg.SubscribeKey,
+				pubnub.WithSecretKey(cfg.SecretKey),
+				pubnub.WithOrigin(cfg.Origin),
+				pubnub.WithLogger(logger),
+				pubnub.WithRequestHook(traceRequest),
+				pubnub.WithTransport(transport),
+				pubnub.WithClockSync(
+					time.Duration(cfg.ClockSyncInterval)*time.Second,
+					time.Duration(cfg.ClockDriftThreshold)*time.Second,
+				),
+			), nil
 		},
 	)
+	if err != nil {
+		// Missing agents are created on delivery
+		logger.Error("Failed to initialize Pubnub agents", "error", err)
+	}
+	w.transport = transport
+	w.unusable = transportErr
+	w.limiter = newRateLimiter(cfg.RateLimit, cfg.ChannelRateLimits)
+	w.breaker = newBreaker(cfg.BreakerThreshold, time.Duration(cfg.BreakerCooldown)*time.Second)
+
+	if cfg.OutcomeDSN != "" {
+		if w.sink, err = newOutcomeSink(cfg.OutcomeDSN, cfg.OutcomeTable, cfg.OutcomeServerPublicKey); err != nil {
+			logger.Error("Invalid outcome_dsn", "error", err)
+		} else {
+			w.sink.Start()
+		}
+	}
+
+	if cfg.TraceEndpoint != "" {
+		if w.tracer, err = newTracer(cfg.TraceEndpoint, cfg.TraceServiceName, cfg.TraceSampleRatio); err != nil {
+			logger.Error("Invalid trace_endpoint", "error", err)
+		} else {
+			w.tracer.Start()
+		}
+	}
+
+	w.Start()
+
+	if cfg.MetricsListen != "" {
+		if err := w.ServeMetrics(cfg.MetricsListen); err != nil {
+			logger.Error("Failed to start metrics listener", "address", cfg.MetricsListen, "error", err)
+		}
+	}
+}
+
+// newWorker creates a worker with a pool of size agents, the worker is
+// usable when some agents failed to be created.
+func newWorker(size int, newAgent func() (*pubnub.Pubnub, error)) (*worker, error) {
+	w := &worker{
+		queue: list.New(),
+		stats: newStats(),
+	}
+	w.ctx, w.cancel = context.WithCancel(context.Background())
+
+	var err error
+	// Replaced agents get a new client and clock offset. Their connections
+	// are left to the shared transport, which closes the broken ones:
+	// closing its idle connections would drop those of every agent.
+	w.connPool, err = newPool(size, cfg.PoolMaxFailures, newAgent, nil)
+
+	return w, err
+}
 
-	// Start Worker
+// Start runs the delivery loop.
+func (w *worker) Start() {
 	go func(w *worker) {
 		for {
 			select {
+			case <-w.ctx.Done():
+				return
 			case <-time.After(200 * time.Millisecond):
-				w.qlock.Lock()
-				for i := 0; i < w.queue.Len(); i++ {
-					message := w.queue.Back()
-					w.queue.Remove(message)
-					// Async send ussing AgentPool
-					go w.deliver(message)
-				}
-				w.qlock.Unlock()
+				w.dispatch(time.Now())
 			}
 		}
 	}(w)
+}
+
+// dispatch starts the deliveries of the queued messages, oldest first.
+// Messages above the rate limits stay queued or are dropped per policy.
+func (w *worker) dispatch(now time.Time) {
+	w.qlock.Lock()
+	defer w.qlock.Unlock()
+
+	// Stop cancels under qlock, no delivery starts after its Wait
+	if w.ctx.Err() != nil {
+		return
+	}
+
+	// Messages waited for an agent since the pool was found exhausted
+	starved := w.starved
+	w.starved = time.Time{}
+
+	dropped, skipped := 0, 0
+	for e := w.queue.Back(); e != nil; {
+		message := e
+		e = e.Prev()
+
+		// Deliveries start with an agent, the others wait in queue
+		agent, ok, err := w.connPool.TryAcquire()
+		if err != nil {
+			logger.Error("Failed to create PubNub agent", "error", err)
+		}
+		if !ok {
+			w.starved = starved
+			if w.starved.IsZero() {
+				w.starved = now
+			}
+			break
+		}
+
+		if !w.breaker.Allow() {
+			// Deliveries paused, the message stays first in queue
+			w.connPool.Put(agent)
+			break
+		}
+		if w.limiter != nil && !w.limiter.Allow(channel(message.Value), now) {
+			w.connPool.Put(agent)
+			if cfg.RateLimitPolicy == rateLimitDrop {
+				w.queue.Remove(message)
+				w.stats.RateDropped()
+				w.stats.Dropped(operation(message.Value))
+				w.report(queuedOutcome(message.Value), "", errRateLimited)
+				dropped++
+				continue
+			}
+			if delay(message.Value) {
+				w.stats.RateDelayed()
+			}
+			if w.limiter.Exhausted(now) {
+				// Newer messages wait as well
+				break
+			}
+			if skipped++; skipped >= rateLimitMaxSkipped {
+				// Next tick, the queue is not walked in full under qlock
+				break
+			}
+			continue
+		}
+
+		w.queue.Remove(message)
+		w.stats.PoolWait(poolWait(message.Value, starved, now))
+		w.inflight.Add(1)
+		go w.deliver(message, agent)
+	}
 
+	if dropped > 0 {
+		logger.Warn("Messages dropped by rate limits", "count", dropped)
+	}
+}
+
+// Stop aborts in-flight deliveries and waits for them to return.
+// Queued messages are dropped.
+func (w *worker) Stop() {
+	w.qlock.Lock()
+	w.cancel()
+	w.qlock.Unlock()
+	w.inflight.Wait()
+
+	if w.metrics != nil {
+		w.metrics.Close()
+	}
+
+	w.qlock.Lock()
+	defer w.qlock.Unlock()
+	if n := w.queue.Len(); n > 0 {
+		logger.Warn("Worker stopped, queued messages dropped", "count", n)
+		for e := w.queue.Front(); e != nil; e = e.Next() {
+			w.stats.Dropped(operation(e.Value))
+			w.report(queuedOutcome(e.Value), "", context.Canceled)
+		}
+		w.queue.Init()
+	}
+
+	if w.sink != nil {
+		w.sink.Stop()
+	}
+	if w.tracer != nil {
+		w.tracer.Stop()
+	}
+}
+
+// Status returns the queue, pool and delivery counters.
+func (w *worker) Status() *status {
+	st := w.stats.snapshot()
+
+	w.qlock.Lock()
+	st.Queue = w.queue.Len()
+	w.qlock.Unlock()
+
+	st.Inflight = atomic.LoadInt64(&w.active)
+	st.Pool.Size, st.Pool.InUse = w.connPool.Size(), w.connPool.InUse()
+	if st.Pool.Size > 0 {
+		st.Pool.Utilization = float64(st.Pool.InUse) / float64(st.Pool.Size)
+	}
+	if w.transport != nil {
+		transport := w.transport.Stats()
+		st.Transport = &transport
+	}
+	st.Breaker = w.breaker.Status()
+
+	return st
 }
 
-func (w *worker) Publish(channel string, message []byte, flags string) {
+// queuedOutcome returns the outcome of a queued message before delivery.
+func queuedOutcome(message interface{}) *outcome {
+	switch m := message.(type) {
+	case *grantMessage:
+		return &outcome{ID: m.ID, Operation: opGrant, Channel: m.Channel, Enqueued: m.Enqueued}
+	case *publishMessage:
+		return &outcome{ID: m.ID, Operation: opPublish, Channel: m.Channel, Enqueued: m.Enqueued}
+	}
+	return &outcome{}
+}
+
+// operation returns the stats operation of a queued message.
+func operation(message interface{}) string {
+	if _, ok := message.(*grantMessage); ok {
+		return opGrant
+	}
+	return opPublish
+}
+
+// poolWait returns the wait for an agent of a message dispatched at now,
+// from its enqueue or from starved when later.
+func poolWait(message interface{}, starved, now time.Time) time.Duration {
+	if starved.IsZero() {
+		return 0
+	}
+	if enqueued := queuedOutcome(message).Enqueued; enqueued.After(starved) {
+		starved = enqueued
+	}
+	return now.Sub(starved)
+}
+
+// messageID returns the correlation id of a queued message.
+func messageID(message interface{}) string {
+	switch m := message.(type) {
+	case *grantMessage:
+		return m.ID
+	case *publishMessage:
+		return m.ID
+	}
+	return ""
+}
+
+// channel returns the channel of a queued message.
+func channel(message interface{}) string {
+	switch m := message.(type) {
+	case *grantMessage:
+		return m.Channel
+	case *publishMessage:
+		return m.Channel
+	}
+	return ""
+}
+
+// delay marks a queued message held back by the rate limits, it returns
+// true the first time.
+func delay(message interface{}) bool {
+	switch m := message.(type) {
+	case *grantMessage:
+		first := !m.Delayed
+		m.Delayed = true
+		return first
+	case *publishMessage:
+		first := !m.Delayed
+		m.Delayed = true
+		return first
+	}
+	return false
+}
+
+// Publish queues message and returns its correlation id.
+func (w *worker) Publish(channel string, message []byte, flags string) string {
+	return w.PublishTraced(channel, message, flags, "")
+}
+
+// PublishTraced is Publish with the W3C traceparent of the caller, the
+// parent of the delivery spans.
+func (w *worker) PublishTraced(channel string, message []byte, flags string, traceparent string) string {
 	w.qlock.Lock()
 	defer w.qlock.Unlock()
 
 	history := strings.Contains(flags, "h")
 
-	w.queue.PushFront(
-		&publishMessage{
-			Channel: channel,
-			Store:   history,
-			Message: message,
-		},
-	)
+	m := &publishMessage{
+		ID:       newMessageID(),
+		Channel:  channel,
+		Store:    history,
+		Message:  message,
+		Enqueued: time.Now(),
+	}
+	if cfg.MetaMessageID {
+		m.Meta = `{"message_id":"` + m.ID + `"}`
+	}
+
+	span := w.startEnqueue(opPublish, m.ID, channel, traceparent, m.Enqueued)
+	m.Trace = span.Context()
+
+	w.queue.PushFront(m)
+	w.stats.Enqueued(opPublish)
+	logger.Debug("Publish queued", "id", m.ID, "channel", channel)
+	span.End(time.Now())
+	return m.ID
+}
+
+// startEnqueue starts the enqueue span of a message, traceparent is
+// ignored when malformed.
+func (w *worker) startEnqueue(op, id, channel, traceparent string, start time.Time) *span {
+	if w.tracer == nil {
+		return nil
+	}
+
+	var parent spanContext
+	if traceparent != "" {
+		var err error
+		if parent, err = parseTraceparent(traceparent); err != nil {
+			logger.Warn("Invalid traceparent ignored", "id", id, "traceparent", traceparent)
+		}
+	}
+
+	span := w.tracer.StartSpan("pubnub.enqueue", spanKindProducer, parent, start)
+	span.SetAttributes("pubnub.operation", op, "pubnub.message_id", id, "pubnub.channel", channel)
+	span.SetStatus(nil)
+	return span
 }
 
 func (worker *worker) Grant(channel, auth string, rights string, ttl int) {
@@ -72,51 +395,304 @@ func (worker *worker) Grant(channel, auth string, rights string, ttl int) {
 	write := strings.Contains(rights, "w")
 	//manage := strings.Contains(flags, "m")
 
-	worker.queue.PushFront(
-		&grantMessage{
-			Channel: channel,
-			Auth:    auth,
-			Read:    read,
-			Write:   write,
-			Ttl:     ttl,
-		},
-	)
+	// Never delivered, the settings error was logged at init
+	if worker.unusable != nil {
+		worker.stats.Dropped(opGrant)
+		return
+	}
+
+	m := &grantMessage{
+		ID:       newMessageID(),
+		Channel:  channel,
+		Auth:     auth,
+		Read:     read,
+		Write:    write,
+		Ttl:      ttl,
+		Enqueued: time.Now(),
+	}
+
+	span := worker.startEnqueue(opGrant, m.ID, channel, "", m.Enqueued)
+	m.Trace = span.Context()
+
+	worker.queue.PushFront(m)
+	worker.stats.Enqueued(opGrant)
+	span.End(time.Now())
+}
+
+// GrantToken requests a PAM v3 token, waiting at most timeout.
+func (w *worker) GrantToken(req *pubnub.TokenRequest, timeout time.Duration) (string, error) {
+	ctx, cancel := context.WithTimeout(w.ctx, timeout)
+	defer cancel()
+
+	w.stats.Enqueued(opGrantToken)
+	start := time.Now()
+
+	if w.unusable != nil {
+		w.record(opGrantToken, "", start, w.unusable)
+		return "", w.unusable
+	}
+
+	if !w.breaker.Allow() {
+		w.breaker.Reject()
+		w.record(opGrantToken, "", start, errBreakerOpen)
+		return "", errBreakerOpen
+	}
+
+	acquire, cancelAcquire := context.WithTimeout(ctx, time.Duration(cfg.PoolAcquireTimeout)*time.Second)
+	agent, err := w.connPool.Acquire(acquire)
+	cancelAcquire()
+	w.stats.PoolWait(time.Since(start))
+	if err != nil {
+		w.stats.PoolTimeout()
+		w.record(opGrantToken, "", start, err)
+		return "", err
+	}
+
+	token, err := agent.GrantTokenContext(ctx, req)
+	w.breaker.Record(err)
+	w.release(agent, err)
+	w.stats.Response(opGrantToken, err)
+	w.record(opGrantToken, "", start, err)
+	return token, err
+}
+
+// Resize changes the number of agents of the pool.
+func (w *worker) Resize(size int) {
+	logger.Info("Resizing PubNub agent pool", "from", w.connPool.Size(), "to", size)
+	w.connPool.Resize(size)
+}
+
+// release returns agent to the pool, agents failing to reach PubNub
+// pool_max_failures times in a row are replaced.
+func (w *worker) release(agent *pubnub.Pubnub, err error) {
+	if w.connPool.Release(agent, !transportFailure(err)) {
+		w.stats.AgentDiscarded()
+		logger.Warn("PubNub agent replaced after repeated failures", "failures", cfg.PoolMaxFailures, "error", err)
+	}
 }
 
-func (w *worker) deliver(message *list.Element) {
+// transportFailure is true when a request did not reach PubNub for another
+// reason than its cancellation. PubNub responses, errors included, are not
+// failures of the agent.
+func transportFailure(err error) bool {
+	var apiErr *pubnub.APIError
+	return err != nil && !errors.As(err, &apiErr) && !pubnub.Aborted(err)
+}
 
-	agent := w.connPool.GetConnection().(*pubnub.Pubnub)
-	defer w.connPool.ReleaseConnection(agent)
+// requeue puts back a message at its place in the queue, by correlation
+// id, so messages put back one after the other keep their order.
+func (w *worker) requeue(message interface{}) {
+	w.qlock.Lock()
+	defer w.qlock.Unlock()
+
+	id := messageID(message)
+	e := w.queue.Back()
+	for e != nil && messageID(e.Value) < id {
+		e = e.Prev()
+	}
+	if e == nil {
+		w.queue.PushFront(message)
+		return
+	}
+	w.queue.InsertAfter(message, e)
+}
+
+// pause puts back a message whose delivery failed while the circuit
+// breaker is open, it is delivered first once PubNub recovers. It returns
+// false when the delivery should go on.
+func (w *worker) pause(message interface{}, err error) bool {
+	if !pubnub.Retryable(err) || !w.breaker.Open() || w.ctx.Err() != nil {
+		return false
+	}
+
+	o := queuedOutcome(message)
+	logger.Debug("Delivery paused by the circuit breaker", "id", o.ID, "channel", o.Channel)
+	w.requeue(message)
+	return true
+}
+
+// record counts the outcome of a delivery started at start, deliveries
+// aborted by Stop are dropped.
+func (w *worker) record(op, id string, start time.Time, err error) {
+	switch {
+	case err == nil:
+		w.stats.Delivered(op, time.Since(start), id)
+	case w.ctx.Err() != nil:
+		w.stats.Dropped(op)
+	default:
+		w.stats.Failed(op, err)
+	}
+}
+
+// report sends the outcome of a message to the sink, deliveries aborted
+// by Stop are dropped.
+func (w *worker) report(o *outcome, timetoken string, err error) {
+	if w.sink == nil {
+		return
+	}
+
+	o.Finished = time.Now()
+	o.Timetoken = timetoken
+
+	var apiErr *pubnub.APIError
+	switch {
+	case err == nil:
+		o.Status, o.HTTPStatus = outcomeDelivered, 200
+	case errors.As(err, &apiErr):
+		o.Status, o.HTTPStatus = outcomeFailed, apiErr.Status
+	default:
+		o.Status = outcomeFailed
+	}
+	if err != nil {
+		if w.ctx.Err() != nil || errors.Is(err, errRateLimited) {
+			o.Status = outcomeDropped
+		}
+		o.Error = logger.redact(err.Error())
+	}
+
+	w.sink.Record(o)
+}
+
+// startDelivery records the queue wait span of a message and starts its
+// delivery span, both children of the enqueue span.
+func (w *worker) startDelivery(o *outcome, trace spanContext, start time.Time) *span {
+	if w.tracer == nil || !trace.Valid() {
+		return nil
+	}
+
+	wait := w.tracer.StartSpan("pubnub.queue_wait", spanKindInternal, trace, o.Enqueued)
+	wait.SetAttributes("pubnub.message_id", o.ID)
+	wait.End(start)
+
+	span := w.tracer.StartSpan("pubnub."+o.Operation, spanKindConsumer, trace, start)
+	span.SetAttributes("pubnub.message_id", o.ID, "pubnub.channel", o.Channel)
+	return span
+}
+
+// endDelivery ends a delivery span with the outcome of the message.
+func endDelivery(span *span, o *outcome, timetoken string, err error) {
+	span.SetAttributes("pubnub.attempts", o.Attempts)
+	if timetoken != "" {
+		span.SetAttributes("pubnub.timetoken", timetoken)
+	}
+	span.SetStatus(err)
+	span.End(time.Now())
+}
+
+// rest waits before a retry, it returns false when the worker is stopped.
+func (w *worker) rest(d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return true
+	case <-w.ctx.Done():
+		return false
+	}
+}
+
+// retryBackoff returns the wait before the retry following attempt: the
+// retry_backoff doubled after each retry up to a minute, with up to half
+// of it random.
+func retryBackoff(attempt int) time.Duration {
+	d := time.Duration(cfg.RetryBackoff) * time.Millisecond
+	for i := 1; i < attempt && d < time.Minute; i++ {
+		d *= 2
+	}
+	if d > time.Minute {
+		d = time.Minute
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// retryToken waits for the rate limit token of a retry, it returns false
+// when the worker is stopped.
+func (w *worker) retryToken(channel string) bool {
+	for w.limiter != nil && !w.limiter.Allow(channel, time.Now()) {
+		if !w.rest(100 * time.Millisecond) {
+			return false
+		}
+	}
+	return true
+}
+
+// deliver sends a dequeued message with agent, released on return.
+func (w *worker) deliver(message *list.Element, agent *pubnub.Pubnub) {
+	defer w.inflight.Done()
+
+	atomic.AddInt64(&w.active, 1)
+	defer atomic.AddInt64(&w.active, -1)
+	start := time.Now()
+
+	// Last error of the agent, to replace failing agents
+	var agentErr error
+	defer func() { w.release(agent, agentErr) }()
 
 	// Grant Message
 	if g, ok := message.Value.(*grantMessage); ok {
+		o := queuedOutcome(g)
+		span := w.startDelivery(o, g.Trace, start)
 
 	punubGrant:
-		_, err := agent.Grant(g.Channel, g.Auth, g.Read, g.Write, g.Ttl)
+		o.Attempts++
+		ctx := withDelivery(w.ctx, span, g.Channel, o.Attempts-1)
+		_, err := agent.GrantContext(ctx, g.Channel, g.Auth, g.Read, g.Write, g.Ttl)
+		agentErr = err
+		w.stats.Response(opGrant, err)
+		w.breaker.Record(err)
 		if err != nil {
-			log.Printf("Grant for %s failed %s !", g.Channel, err)
+			logger.Warn("Grant failed", "id", g.ID, "channel", g.Channel, "error", err)
+			if w.pause(g, err) {
+				endDelivery(span, o, "", err)
+				return
+			}
 			// Give a rest to PubNub for retry
-			time.Sleep(100 * time.Millisecond)
-			goto punubGrant
+			if pubnub.Retryable(err) && o.Attempts < cfg.RetryMaxAttempts && w.rest(retryBackoff(o.Attempts)) && w.retryToken(g.Channel) {
+				w.stats.Retried(opGrant)
+				goto punubGrant
+			}
 		}
+		w.record(opGrant, g.ID, start, err)
+		w.report(o, "", err)
+		endDelivery(span, o, "", err)
 	}
 
 	// Publish Message
 	if publish, ok := message.Value.(*publishMessage); ok {
-	pubnubPublish:
+		o := queuedOutcome(publish)
+		span := w.startDelivery(o, publish.Trace, start)
 
-		response, err := agent.Publish(publish.Channel, string(publish.Message), "", publish.Store)
+	pubnubPublish:
+		o.Attempts++
+		ctx := withDelivery(w.ctx, span, publish.Channel, o.Attempts-1)
+		response, err := agent.PublishMetaContext(ctx, publish.Channel, string(publish.Message), publish.Meta, "", publish.Store)
+		agentErr = err
+		w.stats.Response(opPublish, err)
+		w.breaker.Record(err)
 		if err != nil {
-			log.Printf("Publish for %s failed %s !", publish.Channel, err)
+			logger.Warn("Publish failed", "id", publish.ID, "channel", publish.Channel, "error", err)
+			if w.pause(publish, err) {
+				endDelivery(span, o, "", err)
+				return
+			}
 			// Give a rest to PubNub for retry
-			time.Sleep(100 * time.Millisecond)
-			goto pubnubPublish
+			if pubnub.Retryable(err) && o.Attempts < cfg.RetryMaxAttempts && w.rest(retryBackoff(o.Attempts)) && w.retryToken(publish.Channel) {
+				w.stats.Retried(opPublish)
+				goto pubnubPublish
+			}
+			if errors.Is(err, pubnub.ErrAuth) {
+				logger.Error("Publish dropped", "id", publish.ID, "channel", publish.Channel, "payload", string(publish.Message))
+			}
 		}
+		w.record(opPublish, publish.ID, start, err)
 
-		if response.Status == 403 {
-			log.Printf("Publish %d %q: %s", response.Status, response.Message, publish.Message)
+		timetoken := ""
+		if response != nil {
+			timetoken = response.Timetoken()
+			logger.Debug("Published", "id", publish.ID, "channel", publish.Channel, "timetoken", timetoken)
 		}
-
+		w.report(o, timetoken, err)
+		endDelivery(span, o, timetoken, err)
 	}
 
 }
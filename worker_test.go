@@ -0,0 +1,1127 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"lib/database/mysqltest"
+	"lib/net/http/pubnub"
+	"lib/net/http/pubnub/pubnubtest"
+)
+
+// newTestWorker starts a worker delivering to a fake origin.
+func newTestWorker(t *testing.T, size int) (*worker, *pubnubtest.Server) {
+	srv := pubnubtest.NewServer(pubKey, subKey, secKey)
+	t.Cleanup(srv.Close)
+
+	w, err := newWorker(size, func() (*pubnub.Pubnub, error) {
+		return pubnub.New(pubKey, subKey, secKey, "", false, "", pubnub.WithOrigin(srv.URL)), nil
+	})
+	if err != nil {
+		t.Fatalf("newWorker %s", err)
+	}
+	w.Start()
+	t.Cleanup(w.Stop)
+
+	return w, srv
+}
+
+// waitFor polls cond until it is true or the timeout expires.
+func waitFor(t *testing.T, timeout time.Duration, cond func() bool) {
+	deadline := time.Now().Add(timeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("Timeout after %s", timeout)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestWorkerPublish(t *testing.T) {
+	w, srv := newTestWorker(t, 3)
+
+	for i := 0; i < 10; i++ {
+		w.Publish("orders", []byte(fmt.Sprintf(`{"id":%d}`, i)), "h")
+	}
+	w.Publish("orders", []byte(`{"id":10}`), "")
+
+	waitFor(t, 5*time.Second, func() bool {
+		return srv.Count(pubnubtest.EndpointPublish, 200) == 11
+	})
+
+	history := srv.History("orders")
+	if len(history) != 10 {
+		t.Fatalf("Expected 10 messages in history got %d", len(history))
+	}
+	seen := make(map[string]bool)
+	for _, m := range history {
+		seen[string(m.Message)] = true
+	}
+	for i := 0; i < 10; i++ {
+		if message := fmt.Sprintf(`{"id":%d}`, i); !seen[message] {
+			t.Errorf("Missing message %s", message)
+		}
+	}
+}
+
+func TestWorkerGrantRetry(t *testing.T) {
+	w, srv := newTestWorker(t, 1)
+
+	f := pubnubtest.ServerError
+	f.Endpoint = pubnubtest.EndpointGrant
+	srv.Inject(f, 2)
+
+	w.Grant("orders", "auth_AAA", "rw", 60)
+
+	waitFor(t, 5*time.Second, func() bool {
+		return srv.Count(pubnubtest.EndpointGrant, 200) == 1
+	})
+
+	if n := srv.Count(pubnubtest.EndpointGrant, 500); n != 2 {
+		t.Errorf("Expected 2 failed attempts got %d", n)
+	}
+	if g := srv.Grants("orders")["auth_AAA"]; g.R != 1 || g.W != 1 || g.TTL != 60 {
+		t.Errorf("Unexpected grant %+v", g)
+	}
+}
+
+func TestWorkerStop(t *testing.T) {
+	w, srv := newTestWorker(t, 1)
+	srv.SetLatency(time.Minute)
+
+	w.Publish("orders", []byte(`{"id":1}`), "")
+	waitFor(t, 5*time.Second, func() bool {
+		w.qlock.Lock()
+		defer w.qlock.Unlock()
+		return w.queue.Len() == 0
+	})
+
+	start := time.Now()
+	w.Stop()
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("Stop returned after %s", elapsed)
+	}
+}
+
+func TestWorkerStopDispatch(t *testing.T) {
+	w, _ := newTestWorker(t, 2)
+
+	// Dispatches racing Stop start no delivery after it
+	for i := 0; i < 20; i++ {
+		w.Publish("orders", []byte(fmt.Sprintf(`{"id":%d}`, i)), "")
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for w.ctx.Err() == nil {
+			w.dispatch(time.Now())
+		}
+	}()
+	w.Stop()
+	<-done
+
+	w.queue.PushFront(&publishMessage{ID: newMessageID(), Channel: "orders"})
+	w.dispatch(time.Now())
+	if st := w.Status(); st.Inflight != 0 || st.Queue != 1 {
+		t.Errorf("Expected no delivery after stop got queue %d inflight %d", st.Queue, st.Inflight)
+	}
+}
+
+func TestWorkerUnusable(t *testing.T) {
+	w, srv := newTestWorker(t, 1)
+	w.unusable = errors.New("pubnub: invalid proxy url")
+
+	// Nothing is queued for agents which can never be created
+	w.Grant("orders", "auth", "r", 60)
+	req, _ := tokenRequest(30, "client-1", `{"channels":{"orders":"r"}}`)
+	if _, err := w.GrantToken(req, time.Second); err != w.unusable {
+		t.Errorf("Expected the settings error got %v", err)
+	}
+	st := w.Status()
+	if st.Queue != 0 || st.Operations[opGrant].Dropped != 1 || st.Operations[opGrantToken].Failed != 1 {
+		t.Errorf("Unexpected status %+v %+v", st.Operations[opGrant], st.Operations[opGrantToken])
+	}
+	if n := len(srv.Requests()); n != 0 {
+		t.Errorf("Expected no request got %d", n)
+	}
+}
+
+func TestWorkerPublishRetry(t *testing.T) {
+	w, srv := newTestWorker(t, 1)
+
+	f := pubnubtest.ServerError
+	f.Endpoint = pubnubtest.EndpointPublish
+	srv.Inject(f, 2)
+	f = pubnubtest.Forbidden
+	f.Endpoint = pubnubtest.EndpointPublish
+	srv.Inject(f, 1)
+
+	// 500 is retried until the 403, which is not
+	w.Publish("orders", []byte(`{"id":1}`), "h")
+
+	waitFor(t, 5*time.Second, func() bool {
+		return srv.Count(pubnubtest.EndpointPublish, 403) == 1
+	})
+	time.Sleep(300 * time.Millisecond)
+
+	if n := srv.Count(pubnubtest.EndpointPublish, 0); n != 3 {
+		t.Errorf("Expected 3 attempts got %d", n)
+	}
+	if n := len(srv.History("orders")); n != 0 {
+		t.Errorf("Expected no delivered message got %d", n)
+	}
+}
+
+func TestWorkerRetryLimit(t *testing.T) {
+	w, srv := newTestWorker(t, 1)
+
+	f := pubnubtest.ServerError
+	f.Endpoint = pubnubtest.EndpointPublish
+	srv.Inject(f, 5)
+
+	// Given up after retry_max_attempts with a growing backoff
+	start := time.Now()
+	w.Publish("orders", []byte(`{"id":1}`), "")
+	waitFor(t, 5*time.Second, func() bool {
+		return w.Status().Operations[opPublish].Failed == 1
+	})
+	if n := srv.Count(pubnubtest.EndpointPublish, 0); n != cfg.RetryMaxAttempts {
+		t.Errorf("Expected %d attempts got %d", cfg.RetryMaxAttempts, n)
+	}
+	if elapsed := time.Since(start); elapsed < 150*time.Millisecond {
+		t.Errorf("Expected backoffs of 50ms and 100ms at least got %s", elapsed)
+	}
+
+	for attempt := 1; attempt < 20; attempt++ {
+		d := time.Duration(cfg.RetryBackoff) * time.Millisecond << (attempt - 1)
+		if d > time.Minute {
+			d = time.Minute
+		}
+		if b := retryBackoff(attempt); b < d/2 || b > d {
+			t.Errorf("Backoff of attempt %d out of [%s, %s]: %s", attempt, d/2, d, b)
+		}
+	}
+}
+
+func TestWorkerGrantToken(t *testing.T) {
+	w, srv := newTestWorker(t, 1)
+
+	req, err := tokenRequest(30, "client-1", `{"channels":{"orders":"r"}}`)
+	if err != nil {
+		t.Fatalf("tokenRequest %s", err)
+	}
+	token, err := w.GrantToken(req, time.Second)
+	if err != nil {
+		t.Fatalf("GrantToken %s", err)
+	}
+	if tokens := srv.Tokens(); len(tokens) != 1 || tokens[0] != token {
+		t.Errorf("Expected token %s got %v", token, tokens)
+	}
+
+	srv.SetLatency(500 * time.Millisecond)
+	if _, err := w.GrantToken(req, 100*time.Millisecond); err == nil {
+		t.Errorf("Expected timeout error")
+	}
+}
+
+func TestWorkerStatus(t *testing.T) {
+	w, srv := newTestWorker(t, 2)
+
+	// The grant is delivered with the publishes
+	publishError := pubnubtest.ServerError
+	publishError.Endpoint = pubnubtest.EndpointPublish
+	srv.Inject(publishError, 1)
+	for i := 0; i < 3; i++ {
+		w.Publish("orders", []byte(fmt.Sprintf(`{"id":%d}`, i)), "")
+	}
+	srv.Inject(pubnubtest.Fault{Endpoint: pubnubtest.EndpointGrant, Status: 403, Body: "{}"}, 1)
+	w.Grant("orders", "auth", "r", 60)
+
+	waitFor(t, 5*time.Second, func() bool {
+		st := w.Status()
+		return st.Operations[opPublish].Delivered == 3 && st.Operations[opGrant].Failed == 1
+	})
+
+	st := w.Status()
+	if p := st.Operations[opPublish]; p.Enqueued != 3 || p.Retried != 1 || p.Failed != 0 {
+		t.Errorf("Unexpected publish counters %+v", p)
+	}
+	if g := st.Operations[opGrant]; g.Enqueued != 1 || g.Delivered != 0 {
+		t.Errorf("Unexpected grant counters %+v", g)
+	}
+	if st.LastError == nil || st.LastError.Time.IsZero() {
+		t.Errorf("Expected last error got %+v", st.LastError)
+	}
+	if st.LatencyMs.Samples != 3 || st.LatencyMs.P50 <= 0 || st.LatencyMs.Max < st.LatencyMs.P99 {
+		t.Errorf("Unexpected latency %+v", st.LatencyMs)
+	}
+	if st.Queue != 0 || st.Inflight != 0 || st.Pool.Size != 2 || st.Pool.InUse != 0 {
+		t.Errorf("Unexpected status %+v", st)
+	}
+}
+
+func TestStatsLastErrorRedacted(t *testing.T) {
+	s := newStats()
+	s.Failed(opGrant, fmt.Errorf("Get https://ps.pndsn.com/v3/pam/%s/grant?auth=reader-secret&signature=abc: EOF", subKey))
+
+	st := s.snapshot()
+	if st.LastError == nil || strings.Contains(st.LastError.Message, "reader-secret") || strings.Contains(st.LastError.Message, "abc") {
+		t.Errorf("Expected the auth key and signature redacted got %+v", st.LastError)
+	}
+}
+
+func TestPercentile(t *testing.T) {
+	var sorted []time.Duration
+	for i := 1; i <= 100; i++ {
+		sorted = append(sorted, time.Duration(i)*time.Millisecond)
+	}
+	for p, expected := range map[int]float64{50: 50, 90: 90, 99: 99, 100: 100} {
+		if v := percentile(sorted, p); v != expected {
+			t.Errorf("p%d expected %v got %v", p, expected, v)
+		}
+	}
+	if percentile(nil, 50) != 0 {
+		t.Errorf("Expected 0 without samples")
+	}
+}
+
+func TestWorkerMetrics(t *testing.T) {
+	w, srv := newTestWorker(t, 2)
+
+	srv.Inject(pubnubtest.ServerError, 1)
+	id := w.Publish("orders", []byte(`{"id":1}`), "")
+	waitFor(t, 5*time.Second, func() bool {
+		return w.Status().Operations[opPublish].Delivered == 1
+	})
+
+	var out strings.Builder
+	w.WriteMetrics(&out)
+	metrics := out.String()
+
+	if strings.Contains(metrics, id) {
+		t.Errorf("Expected no exemplar in the Prometheus text format")
+	}
+
+	for _, line := range []string{
+		"# TYPE pubnub_udf_queue_depth gauge",
+		"pubnub_udf_queue_depth 0",
+		"pubnub_udf_pool_agents 2",
+		`pubnub_udf_messages_total{operation="publish",outcome="enqueued"} 1`,
+		`pubnub_udf_messages_total{operation="publish",outcome="delivered"} 1`,
+		`pubnub_udf_retries_total{operation="publish"} 1`,
+		`pubnub_udf_responses_total{operation="publish",status="200"} 1`,
+		`pubnub_udf_responses_total{operation="publish",status="500"} 1`,
+		`pubnub_udf_delivery_duration_seconds_bucket{operation="publish",le="+Inf"} 1`,
+		`pubnub_udf_delivery_duration_seconds_count{operation="publish"} 1`,
+		// Deliveries wait in queue, not for the pool
+		`pubnub_udf_pool_wait_seconds_count 1`,
+	} {
+		if !strings.Contains(metrics, line+"\n") {
+			t.Errorf("Expected %q in\n%s", line, metrics)
+		}
+	}
+}
+
+func TestWorkerOpenMetrics(t *testing.T) {
+	w, srv := newTestWorker(t, 1)
+
+	id := w.Publish("orders", []byte(`{"id":1}`), "")
+	waitFor(t, 5*time.Second, func() bool {
+		return srv.Count(pubnubtest.EndpointPublish, 200) == 1
+	})
+	waitFor(t, time.Second, func() bool {
+		return w.Status().Operations[opPublish].Delivered == 1
+	})
+
+	var out strings.Builder
+	w.WriteOpenMetrics(&out)
+	metrics := out.String()
+
+	for _, line := range []string{
+		"# TYPE pubnub_udf_messages counter\n",
+		`pubnub_udf_messages_total{operation="publish",outcome="delivered"} 1` + "\n",
+		`pubnub_udf_delivery_duration_seconds_bucket{operation="publish",le="+Inf"} 1` + "\n",
+		`} 1 # {message_id="` + id + `"} `,
+	} {
+		if !strings.Contains(metrics, line) {
+			t.Errorf("Expected %q in\n%s", line, metrics)
+		}
+	}
+	if !strings.HasSuffix(metrics, "\n# EOF\n") {
+		t.Errorf("Expected # EOF at the end of\n%s", metrics)
+	}
+}
+
+func TestWorkerPublishMeta(t *testing.T) {
+	w, srv := newTestWorker(t, 1)
+
+	cfg.MetaMessageID = true
+	defer func() { cfg.MetaMessageID = false }()
+
+	id := w.Publish("orders", []byte(`{"id":1}`), "h")
+	if len(id) != 26 {
+		t.Fatalf("Expected a ULID got %q", id)
+	}
+	waitFor(t, 5*time.Second, func() bool {
+		return len(srv.History("orders")) == 1
+	})
+
+	if meta := string(srv.History("orders")[0].Meta); meta != `{"message_id":"`+id+`"}` {
+		t.Errorf("Unexpected meta %s", meta)
+	}
+}
+
+func TestULID(t *testing.T) {
+	if id := encodeULID([16]byte{}); id != "00000000000000000000000000" {
+		t.Errorf("Unexpected zero ULID %s", id)
+	}
+	var max [16]byte
+	for i := range max {
+		max[i] = 0xff
+	}
+	if id := encodeULID(max); id != "7ZZZZZZZZZZZZZZZZZZZZZZZZZ" {
+		t.Errorf("Unexpected max ULID %s", id)
+	}
+
+	// Timestamp of the ULID specification example
+	var g ulidGenerator
+	at := time.Unix(0, 1469918176385*int64(time.Millisecond))
+	first := g.New(at)
+	if first[:10] != "01ARYZ6S41" {
+		t.Errorf("Unexpected timestamp in %s", first)
+	}
+
+	// Monotonic in the same millisecond and when the clock goes back
+	previous := first
+	for _, t2 := range []time.Time{at, at, at.Add(-time.Second)} {
+		id := g.New(t2)
+		if id <= previous || id[:10] != "01ARYZ6S41" {
+			t.Errorf("Expected %s after %s", id, previous)
+		}
+		previous = id
+	}
+	if id := g.New(at.Add(time.Millisecond)); id <= previous {
+		t.Errorf("Expected %s after %s", id, previous)
+	}
+}
+
+func TestFormatLabels(t *testing.T) {
+	if l := formatLabels([]string{"a", `x"y\z` + "\n"}); l != `{a="x\"y\\z\n"}` {
+		t.Errorf("Unexpected labels %s", l)
+	}
+	if l := formatLabels(nil); l != "" {
+		t.Errorf("Unexpected labels %s", l)
+	}
+}
+
+func TestWorkerOutcomes(t *testing.T) {
+	w, srv := newTestWorker(t, 1)
+
+	db := mysqltest.NewServer("udf", "secret")
+	t.Cleanup(db.Close)
+
+	sink, err := newOutcomeSink(db.DSN("audit"), "pubnub_outcomes", "")
+	if err != nil {
+		t.Fatalf("newOutcomeSink %s", err)
+	}
+	sink.Start()
+	w.sink = sink
+
+	srv.Inject(pubnubtest.ServerError, 1)
+	id := w.Publish("orders", []byte(`{"id":1}`), "")
+
+	inserted := func(values ...string) func() bool {
+		return func() bool {
+			for _, stmt := range db.Statements() {
+				found := true
+				for _, v := range values {
+					found = found && strings.Contains(stmt, v)
+				}
+				if found {
+					return true
+				}
+			}
+			return false
+		}
+	}
+	waitFor(t, 5*time.Second, inserted(
+		"INSERT INTO `pubnub_outcomes`",
+		quoteString(id),
+		quoteString(opPublish)+","+quoteString("orders")+","+quoteString(outcomeDelivered)+",200,",
+		",NULL,2,",
+	))
+
+	// The sink reconnects after a lost connection
+	db.CloseConnections()
+	w.Grant("orders", "reader-key", "r", 5)
+	waitFor(t, 5*time.Second, inserted(quoteString(opGrant)))
+
+	if n := sink.Dropped(); n != 0 {
+		t.Errorf("Expected no dropped outcome got %d", n)
+	}
+}
+
+func TestOutcomeSinkFullAuth(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("GenerateKey %s", err)
+	}
+	db := mysqltest.NewServer("udf", "s@cret?")
+	db.SetPlugin(mysqltest.CachingSHA2Password)
+	db.SetFullAuth(key)
+	t.Cleanup(db.Close)
+
+	path := filepath.Join(t.TempDir(), "public_key.pem")
+	if err := ioutil.WriteFile(path, db.PublicKeyPEM(), 0600); err != nil {
+		t.Fatalf("WriteFile %s", err)
+	}
+
+	// The password and the params hold an @
+	sink, err := newOutcomeSink(db.DSN("audit")+"?timeout=2s&connectionAttributes=owner:ops@example.com", "pubnub_outcomes", path)
+	if err != nil {
+		t.Fatalf("newOutcomeSink %s", err)
+	}
+	sink.Start()
+	sink.Record(&outcome{ID: "a1", Operation: opPublish, Channel: "c", Status: outcomeDelivered})
+	sink.Stop()
+
+	// Stop flushed the queued outcome
+	if stmts := db.Statements(); len(stmts) != 1 || !strings.Contains(stmts[0], quoteString("a1")) {
+		t.Errorf("Expected the outcome inserted got %q", stmts)
+	}
+	if n := sink.Dropped(); n != 0 {
+		t.Errorf("Expected no dropped outcome got %d", n)
+	}
+}
+
+func TestOutcomeSinkDSN(t *testing.T) {
+	for _, dsn := range []string{
+		"udf:secret@tcp(127.0.0.1:3306)/audit",
+		"udf:secret@tcp(localhost)/audit",
+		"udf:secret@unix(/var/run/mysqld/mysqld.sock)/audit",
+		"udf:p@ss@tcp(db.example.com)/audit?tls=true&connectionAttributes=owner:ops@example.com",
+	} {
+		if _, err := newOutcomeSink(dsn, "pubnub_outcomes", ""); err != nil {
+			t.Errorf("newOutcomeSink(%q) %s", dsn, err)
+		}
+	}
+
+	// The password would be sent to any server over the network
+	for _, dsn := range []string{
+		"udf:secret@tcp(db.example.com)/audit",
+		"udf:secret@tcp(10.0.0.5:3306)/audit?tls=preferred",
+		"udf:secret@tcp(db.example.com)/audit?timeout=2s&connectionAttributes=owner:ops@127.0.0.1",
+	} {
+		if _, err := newOutcomeSink(dsn, "pubnub_outcomes", ""); err == nil {
+			t.Errorf("Expected newOutcomeSink(%q) refused", dsn)
+		}
+	}
+
+	if _, err := newOutcomeSink("udf:secret@tcp(db)/audit", "pubnub_outcomes", "/missing.pem"); err == nil {
+		t.Errorf("Expected missing outcome_server_public_key error")
+	}
+}
+
+func TestQuote(t *testing.T) {
+	if q := quoteString("it's\\"); q != "_utf8mb4 X'697427735c'" {
+		t.Errorf("Unexpected quote %s", q)
+	}
+	if q := quoteString(""); q != "''" {
+		t.Errorf("Unexpected quote %s", q)
+	}
+	if q := quoteIdentifier("app.pubnub`outcomes"); q != "`app`.`pubnub``outcomes`" {
+		t.Errorf("Unexpected identifier %s", q)
+	}
+	if q := quoteTime(time.Date(2021, 5, 1, 10, 0, 0, 123456000, time.FixedZone("CEST", 7200))); q != "'2021-05-01 08:00:00.123456'" {
+		t.Errorf("Unexpected time %s", q)
+	}
+}
+
+func TestInsertOutcomes(t *testing.T) {
+	at := time.Date(2024, 5, 1, 10, 0, 0, 123456000, time.UTC)
+	stmt := insertOutcomes("db.outcomes", []*outcome{
+		{ID: "a1", Operation: opPublish, Channel: "c", Status: outcomeDelivered, HTTPStatus: 200, Timetoken: "17145", Attempts: 1, Enqueued: at, Finished: at},
+		{ID: "a2", Operation: opGrant, Channel: "c", Status: outcomeFailed, Error: "timeout", Attempts: 3, Enqueued: at, Finished: at},
+	})
+
+	for _, part := range []string{
+		"INSERT INTO `db`.`outcomes` (message_id, operation, channel, status, http_status, timetoken, error, attempts, enqueued_at, finished_at) VALUES (",
+		quoteString("17145") + ",NULL,1,'2024-05-01 10:00:00.123456','2024-05-01 10:00:00.123456'),(",
+		quoteString(outcomeFailed) + ",NULL,NULL," + quoteString("timeout") + ",3,",
+	} {
+		if !strings.Contains(stmt, part) {
+			t.Errorf("Expected %q in %s", part, stmt)
+		}
+	}
+}
+
+func TestWorkerTracing(t *testing.T) {
+	srv := pubnubtest.NewServer(pubKey, subKey, secKey)
+	t.Cleanup(srv.Close)
+
+	var (
+		mu    sync.Mutex
+		spans []map[string]interface{}
+	)
+	collector := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		var req struct {
+			ResourceSpans []struct {
+				ScopeSpans []struct {
+					Spans []map[string]interface{}
+				}
+			}
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Errorf("Invalid export %s", err)
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		for _, rs := range req.ResourceSpans {
+			for _, ss := range rs.ScopeSpans {
+				spans = append(spans, ss.Spans...)
+			}
+		}
+	}))
+	t.Cleanup(collector.Close)
+
+	w, err := newWorker(1, func() (*pubnub.Pubnub, error) {
+		return pubnub.New(pubKey, subKey, secKey, "", false, "", pubnub.WithOrigin(srv.URL), pubnub.WithRequestHook(traceRequest)), nil
+	})
+	if err != nil {
+		t.Fatalf("newWorker %s", err)
+	}
+	if w.tracer, err = newTracer(collector.URL+"/v1/traces", "test", 0); err != nil {
+		t.Fatalf("newTracer %s", err)
+	}
+	w.tracer.Start()
+	w.Start()
+
+	srv.Inject(pubnubtest.ServerError, 1)
+	w.PublishTraced("orders", []byte(`{"id":1}`), "", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	waitFor(t, 5*time.Second, func() bool {
+		return w.Status().Operations[opPublish].Delivered == 1
+	})
+	w.PublishTraced("orders", []byte(`{"id":2}`), "", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00")
+	w.Publish("orders", []byte(`{"id":3}`), "")
+	waitFor(t, 5*time.Second, func() bool {
+		return w.Status().Operations[opPublish].Delivered == 3
+	})
+	w.Stop()
+
+	// Only the sampled caller is traced, ratio 0 skips the others
+	byName := make(map[string][]map[string]interface{})
+	for _, s := range spans {
+		if s["traceId"] != "4bf92f3577b34da6a3ce929d0e0e4736" {
+			t.Errorf("Unexpected trace %v", s["traceId"])
+		}
+		byName[s["name"].(string)] = append(byName[s["name"].(string)], s)
+	}
+
+	enqueue := byName["pubnub.enqueue"]
+	if len(enqueue) != 1 || enqueue[0]["parentSpanId"] != "00f067aa0ba902b7" {
+		t.Fatalf("Expected an enqueue span child of the caller got %v", enqueue)
+	}
+	for _, name := range []string{"pubnub.queue_wait", "pubnub.publish"} {
+		if len(byName[name]) != 1 || byName[name][0]["parentSpanId"] != enqueue[0]["spanId"] {
+			t.Errorf("Expected a %s span child of the enqueue span got %v", name, byName[name])
+		}
+	}
+
+	requests := byName["GET publish"]
+	if len(requests) != 2 {
+		t.Fatalf("Expected 2 request spans got %v", requests)
+	}
+	for i, status := range []string{"500", "200"} {
+		attributes := fmt.Sprint(requests[i]["attributes"])
+		for _, attribute := range []string{
+			"map[key:http.response.status_code value:map[intValue:" + status + "]]",
+			"map[key:pubnub.retry_count value:map[intValue:" + strconv.Itoa(i) + "]]",
+			"map[key:pubnub.channel value:map[stringValue:orders]]",
+		} {
+			if !strings.Contains(attributes, attribute) {
+				t.Errorf("Expected %s in %s", attribute, attributes)
+			}
+		}
+		if requests[i]["parentSpanId"] != byName["pubnub.publish"][0]["spanId"] {
+			t.Errorf("Expected request spans children of the delivery span")
+		}
+	}
+}
+
+func TestParseTraceparent(t *testing.T) {
+	c, err := parseTraceparent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	if err != nil || !c.Sampled || hex.EncodeToString(c.TraceID[:]) != "4bf92f3577b34da6a3ce929d0e0e4736" ||
+		hex.EncodeToString(c.SpanID[:]) != "00f067aa0ba902b7" {
+		t.Errorf("Unexpected context %+v %v", c, err)
+	}
+
+	// Future versions may append fields
+	if _, err := parseTraceparent("cc-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00-extra"); err != nil {
+		t.Errorf("Unexpected error %s", err)
+	}
+
+	for _, invalid := range []string{
+		"",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra",
+		"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01",
+		"00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e473x-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-0g",
+	} {
+		if _, err := parseTraceparent(invalid); err == nil {
+			t.Errorf("Expected %q to be invalid", invalid)
+		}
+	}
+}
+
+func TestPool(t *testing.T) {
+	created := 0
+	fail := true
+	newItem := func() (*int, error) {
+		if fail {
+			return nil, errors.New("refused")
+		}
+		created++
+		n := created
+		return &n, nil
+	}
+	var closed []int
+	closeItem := func(item *int) { closed = append(closed, *item) }
+
+	// A failed init is filled on acquire
+	p, err := newPool(2, 2, newItem, closeItem)
+	if err == nil {
+		t.Fatalf("Expected init error")
+	}
+	fail = false
+	a, err := p.Acquire(context.Background())
+	if err != nil || *a != 1 {
+		t.Fatalf("Acquire %v %v", a, err)
+	}
+	b, _ := p.Acquire(context.Background())
+
+	// Exhausted: the acquire times out
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := p.Acquire(ctx); err != context.DeadlineExceeded {
+		t.Errorf("Expected deadline exceeded got %v", err)
+	}
+	if p.InUse() != 2 {
+		t.Errorf("Expected 2 items in use got %d", p.InUse())
+	}
+
+	// A waiting acquire gets the released item
+	got := make(chan *int)
+	go func() {
+		item, _ := p.Acquire(context.Background())
+		got <- item
+	}()
+	time.Sleep(10 * time.Millisecond)
+	p.Release(b, true)
+	if item := <-got; item != b {
+		t.Errorf("Expected released item %d got %d", *b, *item)
+	}
+
+	// Replaced after 2 consecutive failures
+	if p.Release(a, false) {
+		t.Errorf("Expected item kept after 1 failure")
+	}
+	a, _ = p.Acquire(context.Background())
+	if !p.Release(a, false) || len(closed) != 1 || closed[0] != 1 {
+		t.Errorf("Expected item 1 discarded got %v", closed)
+	}
+	if c, _ := p.Acquire(context.Background()); *c != 3 {
+		t.Errorf("Expected replacement item 3 got %d", *c)
+	}
+
+	// Shrinking discards items on release, growing creates them on acquire
+	p.Resize(1)
+	p.Release(b, true)
+	if p.Size() != 1 || p.InUse() != 1 || len(closed) != 2 {
+		t.Errorf("Unexpected pool after shrink: size %d in use %d closed %v", p.Size(), p.InUse(), closed)
+	}
+	p.Resize(3)
+	if d, err := p.Acquire(context.Background()); err != nil || *d != 4 {
+		t.Errorf("Expected new item 4 got %v %v", d, err)
+	}
+}
+
+func TestWorkerReplacesFailingAgents(t *testing.T) {
+	w, srv := newTestWorker(t, 1)
+
+	req, err := tokenRequest(30, "client-1", `{"channels":{"orders":"r"}}`)
+	if err != nil {
+		t.Fatalf("tokenRequest %s", err)
+	}
+
+	// Error responses reached PubNub, the agent is kept
+	srv.Inject(pubnubtest.ServerError, cfg.PoolMaxFailures)
+	for i := 0; i < cfg.PoolMaxFailures; i++ {
+		if _, err := w.GrantToken(req, time.Second); err == nil {
+			t.Fatalf("Expected an error response")
+		}
+	}
+	if st := w.Status(); st.Pool.Discarded != 0 {
+		t.Errorf("Expected the agent kept got %+v", st.Pool)
+	}
+
+	srv.Close()
+	for i := 0; i < cfg.PoolMaxFailures; i++ {
+		if _, err := w.GrantToken(req, time.Second); err == nil {
+			t.Fatalf("Expected an error from a closed origin")
+		}
+	}
+
+	st := w.Status()
+	if st.Pool.Discarded != 1 || st.Pool.Size != 1 || st.Pool.InUse != 0 {
+		t.Errorf("Expected the agent to be replaced got %+v", st.Pool)
+	}
+}
+
+func TestWorkerAcquireTimeout(t *testing.T) {
+	w, srv := newTestWorker(t, 1)
+
+	defer func(timeout int) { cfg.PoolAcquireTimeout = timeout }(cfg.PoolAcquireTimeout)
+	cfg.PoolAcquireTimeout = 1
+
+	// The only agent is held by a slow grant
+	srv.SetLatency(1500 * time.Millisecond)
+	req, _ := tokenRequest(30, "client-1", `{"channels":{"orders":"r"}}`)
+	go w.GrantToken(req, 5*time.Second)
+	time.Sleep(50 * time.Millisecond)
+
+	// A second grant gives up, messages wait in queue for the agent
+	if _, err := w.GrantToken(req, 5*time.Second); err != context.DeadlineExceeded {
+		t.Errorf("Expected acquire timeout got %v", err)
+	}
+	w.Publish("orders", []byte(`{"id":1}`), "")
+	w.Publish("orders", []byte(`{"id":2}`), "h")
+	if st := w.Status(); st.Queue != 2 || st.Inflight != 0 {
+		t.Errorf("Expected queued messages got queue %d inflight %d", st.Queue, st.Inflight)
+	}
+
+	waitFor(t, 5*time.Second, func() bool {
+		return w.Status().Operations[opPublish].Delivered == 2
+	})
+	if st := w.Status(); st.Pool.AcquireTimeouts != 1 || st.Operations[opPublish].Failed != 0 {
+		t.Errorf("Expected one grant acquire timeout got %+v %+v", st.Pool, st.Operations[opPublish])
+	}
+
+	// The publishes waited for the agent as well
+	w.stats.mu.Lock()
+	defer w.stats.mu.Unlock()
+	if waits := w.stats.poolWait.counts[len(w.stats.poolWait.counts)-1]; waits != 4 || w.stats.poolWait.sum < 1 {
+		t.Errorf("Expected 4 pool waits of 1s in total got %d of %.3fs", waits, w.stats.poolWait.sum)
+	}
+}
+
+func TestPoolHandoff(t *testing.T) {
+	p, _ := newPool(1, 0, func() (int, error) { return 1, nil }, nil)
+	item, _ := p.Acquire(context.Background())
+	if _, ok, _ := p.TryAcquire(); ok {
+		t.Fatalf("Expected no idle item")
+	}
+
+	// Waiters are served one by release, oldest first
+	got := make(chan int, 3)
+	for i := 0; i < 3; i++ {
+		go func(i int) {
+			p.Acquire(context.Background())
+			got <- i
+		}(i)
+		time.Sleep(10 * time.Millisecond)
+	}
+	for i := 0; i < 3; i++ {
+		p.Release(item, true)
+		if n := <-got; n != i {
+			t.Errorf("Expected waiter %d served got %d", i, n)
+		}
+		select {
+		case n := <-got:
+			t.Fatalf("Expected one waiter served by release got %d", n)
+		case <-time.After(20 * time.Millisecond):
+		}
+	}
+
+	// Put keeps the item for the next acquire
+	p.Put(item)
+	if _, ok, _ := p.TryAcquire(); !ok || p.InUse() != 1 {
+		t.Errorf("Expected the put item got in use %d", p.InUse())
+	}
+}
+
+func TestWorkerRequeueOrder(t *testing.T) {
+	w := &worker{queue: list.New()}
+	messages := make([]*publishMessage, 5)
+	for i := range messages {
+		messages[i] = &publishMessage{ID: newMessageID()}
+	}
+	w.queue.PushFront(messages[3])
+	w.queue.PushFront(messages[4])
+
+	// Put back in any order, delivered oldest first
+	for _, i := range []int{0, 2, 1} {
+		w.requeue(messages[i])
+	}
+	i := 0
+	for e := w.queue.Back(); e != nil; e = e.Prev() {
+		if e.Value != messages[i] {
+			t.Errorf("Expected message %d at %d", i, i)
+		}
+		i++
+	}
+}
+
+func TestWorkerSharedTransport(t *testing.T) {
+	srv := pubnubtest.NewServer(pubKey, subKey, secKey)
+	defer srv.Close()
+
+	transport, err := pubnub.NewTransport(&pubnub.TransportConfig{MaxIdleConnsPerHost: 3})
+	if err != nil {
+		t.Fatalf("NewTransport %s", err)
+	}
+	w, err := newWorker(3, func() (*pubnub.Pubnub, error) {
+		return pubnub.New(pubKey, subKey, secKey, "", false, "", pubnub.WithOrigin(srv.URL), pubnub.WithTransport(transport)), nil
+	})
+	if err != nil {
+		t.Fatalf("newWorker %s", err)
+	}
+	w.transport = transport
+	w.Start()
+	defer w.Stop()
+
+	for i := 0; i < 10; i++ {
+		w.Publish("orders", []byte(fmt.Sprintf(`{"id":%d}`, i)), "")
+	}
+	waitFor(t, 5*time.Second, func() bool {
+		return w.Status().Operations[opPublish].Delivered == 10
+	})
+
+	// At most one connection by agent
+	st := w.Status().Transport
+	if st == nil || st.Requests != 10 || st.Created > 3 || st.Reused+st.Created != 10 {
+		t.Fatalf("Unexpected transport stats %+v", st)
+	}
+
+	var out strings.Builder
+	w.WriteMetrics(&out)
+	for _, line := range []string{
+		"pubnub_udf_http_requests_total 10\n",
+		fmt.Sprintf("pubnub_udf_http_connections_total{reused=\"true\"} %d\n", st.Reused),
+		fmt.Sprintf("pubnub_udf_http_connections_total{reused=\"false\"} %d\n", st.Created),
+		"pubnub_udf_tls_handshakes_total 0\n",
+	} {
+		if !strings.Contains(out.String(), line) {
+			t.Errorf("Missing %q in\n%s", line, out.String())
+		}
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	if newRateLimiter(rateLimit{}, map[string]rateLimit{"orders-*": {}}) != nil {
+		t.Fatalf("Expected no limiter without rates")
+	}
+
+	l := newRateLimiter(rateLimit{Rate: 10, Burst: 5}, map[string]rateLimit{
+		"orders-*":  {Rate: 1, Burst: 2},
+		"orders-eu": {Rate: 2},
+	})
+	now := time.Now()
+
+	allowed := func(channel string, n int) int {
+		count := 0
+		for i := 0; i < n; i++ {
+			if l.Allow(channel, now) {
+				count++
+			}
+		}
+		return count
+	}
+
+	// Channel burst, then the longest pattern, then the global burst
+	if n := allowed("orders-us", 3); n != 2 {
+		t.Errorf("Expected 2 orders-us messages got %d", n)
+	}
+	if n := allowed("orders-eu", 3); n != 2 {
+		t.Errorf("Expected 2 orders-eu messages got %d", n)
+	}
+	if n := allowed("users", 3); n != 1 || !l.Exhausted(now) {
+		t.Errorf("Expected 1 users message and an empty global bucket got %d", n)
+	}
+
+	// Refilled at the rates
+	now = now.Add(time.Second)
+	if n := allowed("orders-us", 3); n != 1 {
+		t.Errorf("Expected 1 orders-us message after 1s got %d", n)
+	}
+	if n := allowed("users", 10); n != 4 {
+		t.Errorf("Expected 4 users messages after 1s got %d", n)
+	}
+}
+
+func TestWorkerRateLimit(t *testing.T) {
+	defer func(policy string) { cfg.RateLimitPolicy = policy }(cfg.RateLimitPolicy)
+
+	for _, policy := range []string{rateLimitDelay, rateLimitDrop} {
+		cfg.RateLimitPolicy = policy
+		w, srv := newTestWorker(t, 3)
+		w.limiter = newRateLimiter(rateLimit{}, map[string]rateLimit{"orders*": {Rate: 5, Burst: 2}})
+
+		for i := 0; i < 4; i++ {
+			w.Publish("orders", []byte(fmt.Sprintf(`{"id":%d}`, i)), "h")
+		}
+		w.Publish("users", []byte(`{"id":1}`), "")
+
+		if policy == rateLimitDrop {
+			waitFor(t, 5*time.Second, func() bool {
+				return w.Status().Operations[opPublish].Delivered == 3
+			})
+			st := w.Status()
+			if st.RateLimit.Dropped != 2 || st.Operations[opPublish].Dropped != 2 || st.Queue != 0 {
+				t.Errorf("Expected 2 dropped messages got %+v %+v", st.RateLimit, st.Operations[opPublish])
+			}
+			continue
+		}
+
+		waitFor(t, 5*time.Second, func() bool {
+			return w.Status().Operations[opPublish].Delivered == 5
+		})
+		if st := w.Status(); st.RateLimit.Delayed != 2 || st.RateLimit.Dropped != 0 {
+			t.Errorf("Expected 2 delayed messages got %+v", st.RateLimit)
+		}
+
+		// Delayed messages keep their order
+		history := srv.History("orders")
+		for i := 2; i < 4; i++ {
+			if message := fmt.Sprintf(`{"id":%d}`, i); string(history[i].Message) != message {
+				t.Errorf("Expected %s delivered %dth got %s", message, i+1, history[i].Message)
+			}
+		}
+	}
+}
+
+func TestWorkerRateLimitRetry(t *testing.T) {
+	w, srv := newTestWorker(t, 1)
+	w.limiter = newRateLimiter(rateLimit{Rate: 2, Burst: 1}, nil)
+	fault := pubnubtest.ServerError
+	fault.Endpoint = pubnubtest.EndpointPublish
+	srv.Inject(fault, 1)
+
+	w.Publish("orders", []byte(`{"id":1}`), "")
+	waitFor(t, 5*time.Second, func() bool {
+		return w.Status().Operations[opPublish].Delivered == 1
+	})
+
+	// The retry waits for a token
+	requests := srv.Requests()
+	if len(requests) != 2 {
+		t.Fatalf("Expected 2 requests got %d", len(requests))
+	}
+	if d := requests[1].Time.Sub(requests[0].Time); d < 400*time.Millisecond {
+		t.Errorf("Expected the retry after a token got it after %s", d)
+	}
+}
+
+func TestBreaker(t *testing.T) {
+	if b := newBreaker(0, time.Second); b != nil || !b.Allow() || b.Open() {
+		t.Fatalf("Expected a disabled breaker")
+	}
+
+	b := newBreaker(2, 100*time.Millisecond)
+	unavailable := &pubnub.APIError{Status: 503, Retryable: true}
+
+	// Refusals and aborted requests are not failures
+	b.Record(unavailable)
+	b.Record(&pubnub.APIError{Status: 403})
+	b.Record(unavailable)
+	b.Record(context.Canceled)
+	if b.Open() || b.Status().Failures != 1 {
+		t.Fatalf("Expected a closed breaker got %+v", b.Status())
+	}
+
+	b.Record(unavailable)
+	if !b.Open() || b.Allow() {
+		t.Fatalf("Expected an open breaker got %+v", b.Status())
+	}
+
+	// A wrapped deadline of the caller leaves it open
+	b.Record(fmt.Errorf("PAM Error Internal: %w", context.DeadlineExceeded))
+	if st := b.Status(); st.State != breakerOpen || st.Failures != 2 {
+		t.Fatalf("Expected an open breaker after a timeout got %+v", st)
+	}
+
+	// One probe after the cooldown, a failed probe opens again
+	time.Sleep(100 * time.Millisecond)
+	if !b.Allow() || b.Allow() || b.Status().State != breakerHalfOpen {
+		t.Fatalf("Expected a single probe got %+v", b.Status())
+	}
+	b.Record(unavailable)
+	if st := b.Status(); st.State != breakerOpen || st.Opened != 2 {
+		t.Fatalf("Expected an open breaker after the probe got %+v", st)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	b.Allow()
+	b.Record(nil)
+	if st := b.Status(); st.State != breakerClosed || st.Failures != 0 || !b.Allow() {
+		t.Errorf("Expected a closed breaker after the probe got %+v", st)
+	}
+}
+
+func TestWorkerBreaker(t *testing.T) {
+	w, srv := newTestWorker(t, 3)
+	w.breaker = newBreaker(2, 500*time.Millisecond)
+
+	srv.Inject(pubnubtest.ServerError, 2)
+	w.Publish("orders", []byte(`{"id":1}`), "")
+	waitFor(t, 5*time.Second, func() bool { return w.breaker.Open() })
+
+	// Paused deliveries stay queued
+	w.Publish("orders", []byte(`{"id":2}`), "")
+	time.Sleep(300 * time.Millisecond)
+	if st := w.Status(); st.Queue != 2 || st.Operations[opPublish].Delivered != 0 {
+		t.Fatalf("Expected paused deliveries got queue %d %+v", st.Queue, st.Operations[opPublish])
+	}
+	if _, err := w.GrantToken(&pubnub.TokenRequest{TTL: 60}, time.Second); !errors.Is(err, errBreakerOpen) {
+		t.Errorf("Expected grant token refused got %v", err)
+	}
+
+	// The probe closes the breaker
+	waitFor(t, 5*time.Second, func() bool {
+		return w.Status().Operations[opPublish].Delivered == 2
+	})
+	st := w.Status()
+	if st.Breaker.State != breakerClosed || st.Breaker.Opened != 1 || st.Breaker.Rejected != 1 || st.Operations[opPublish].Failed != 0 {
+		t.Errorf("Unexpected breaker status %+v %+v", st.Breaker, st.Operations[opPublish])
+	}
+
+	var out strings.Builder
+	w.WriteMetrics(&out)
+	for _, line := range []string{
+		"pubnub_udf_breaker_state{state=\"closed\"} 1\n",
+		"pubnub_udf_breaker_state{state=\"open\"} 0\n",
+		"pubnub_udf_breaker_opened_total 1\n",
+	} {
+		if !strings.Contains(out.String(), line) {
+			t.Errorf("Missing %q in\n%s", line, out.String())
+		}
+	}
+}